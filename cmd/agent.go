@@ -4,96 +4,764 @@ import (
 	"fmt"
 	"github.com/slushie/kubist-agent/couchdb"
 	"github.com/slushie/kubist-agent/kubernetes"
+	"hash/fnv"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/tools/cache"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type KubistAgent struct {
-	ch        chan cache.Delta
+	ch        chan kubernetes.ResourceDelta
 	db        couchdb.DatabaseInterface
 	pool      dynamic.ClientPool
 	Resources []schema.GroupVersionResource
-	Namespace string
+
+	// When set, documents are written to the database Databases picks for
+	// each object, and db only holds the checkpoint.
+	Databases *DatabaseRouter
+
+	// When set, objects are labelled with Cluster in kubist.cluster, and
+	// their document ids start with it, so several clusters can share a
+	// database.
+	Cluster string
+
+	// How document ids are made from objects.
+	IdScheme IdScheme
+
+	// Selectors restrict the objects reflected for each resource.
+	Selectors map[schema.GroupVersionResource]kubernetes.Selectors
+
+	// Objects are redacted before they're written, or recorded as dead
+	// letters, with the DefaultRedactions for their kind, unless their
+	// resource is in NoDefaultRedactions, and the Redactions for their
+	// resource.
+	Redactions          map[schema.GroupVersionResource][]Redaction
+	NoDefaultRedactions map[schema.GroupVersionResource]bool
+
+	// Fields in Prune are removed from every object. Updates that only
+	// change pruned fields, or fields in IgnoreChanges, aren't written.
+	Prune         []FieldPath
+	IgnoreChanges []FieldPath
+
+	// Applied in order to every object, after pruning and redaction.
+	Transformers []Transformer
+
+	// How to keep a JSON Patch for each update. With PatchDocument, they're
+	// written to ChangeEvents.
+	Patches      PatchMode
+	ChangeEvents couchdb.DatabaseInterface
+
+	// When set, every change written is also recorded in History, which is
+	// pruned by sweep.
+	History *HistoryStore
+
+	// When set, deleted objects leave a tombstone document behind. Unless
+	// TombstoneTTL is zero, sweep deletes tombstones older than it.
+	SoftDelete   bool
+	TombstoneTTL time.Duration
+
+	// Resources are watched in each of Namespaces, and in each namespace
+	// whose labels match NamespaceSelector while it matches. If neither is
+	// set, they're watched in every namespace.
+	Namespaces        []string
+	NamespaceSelector labels.Selector
 
 	Watchers *ChannelAggregator
 	PoolSize int
+
+	// Deltas are written to CouchDB in batches of up to BatchSize
+	// documents, or whatever has arrived within BatchInterval.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// Failed batches are retried with Backoff, then recorded in
+	// DeadLetters, if it is set.
+	Backoff     wait.Backoff
+	DeadLetters *DeadLetterStore
+
+	// Watches resume from the resourceVersions saved in Checkpoints, which
+	// are updated every CheckpointInterval.
+	Checkpoints        *CheckpointStore
+	CheckpointInterval time.Duration
+
+	// Whether to delete documents for objects missing from a full list.
+	Reconcile ReconcileMode
+
+	// When set, custom resources matching CRDFilter are watched as their
+	// CustomResourceDefinitions are established, and no longer watched once
+	// they are deleted. If CleanupCRDs is set, their documents are deleted
+	// along with them.
+	WatchCRDs   bool
+	CRDFilter   kubernetes.ResourceFilter
+	CleanupCRDs bool
+
+	// Set when the agent only runs while this replica holds the leader
+	// election lock. Until then, it's a standby and counts as ready.
+	LeaderElect bool
+
+	// Used to find out which resources are namespaced. Without it, every
+	// resource is assumed to be namespaced.
+	Discovery discovery.DiscoveryInterface
+
+	tracker *checkpointTracker
+
+	mu         sync.Mutex
+	namespaced map[schema.GroupVersionResource]bool
+	watchers   map[watcherKey]*kubernetes.ResourceWatcher
+	crdWatcher *kubernetes.ResourceWatcher
+	crds       map[string]customResource // by CRD name
+	nsWatcher  *kubernetes.ResourceWatcher
+	namespaces map[string]bool // watched namespaces, "" for all of them
+	running    bool            // Run has been called
+	started    bool            // every configured watcher has been added
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// Watchers are keyed by the resource and namespace they watch.
+type watcherKey struct {
+	Resource  schema.GroupVersionResource
+	Namespace string
 }
 
 var DefaultPoolSize = 10
+var DefaultBatchSize = 500
+var DefaultBatchInterval = time.Second
+var DefaultCheckpointInterval = 10 * time.Second
+var DefaultBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    8,
+}
 
 func NewKubistAgent(
 	db couchdb.DatabaseInterface,
 	pool dynamic.ClientPool,
 	resources []schema.GroupVersionResource,
-	namespace string,
+	namespaces []string,
 ) *KubistAgent {
-	var ch = make(chan cache.Delta)
+	var ch = make(chan kubernetes.ResourceDelta)
 
 	return &KubistAgent{
-		ch:        ch,
-		db:        db,
-		pool:      pool,
-		Resources: resources,
-		Namespace: namespace,
-		Watchers:  NewChannelAggregator(ch),
-		PoolSize:  DefaultPoolSize,
+		ch:                 ch,
+		db:                 db,
+		pool:               pool,
+		Resources:          resources,
+		Namespaces:         namespaces,
+		Watchers:           NewChannelAggregator(ch),
+		PoolSize:           DefaultPoolSize,
+		BatchSize:          DefaultBatchSize,
+		BatchInterval:      DefaultBatchInterval,
+		Backoff:            DefaultBackoff,
+		CheckpointInterval: DefaultCheckpointInterval,
+		Reconcile:          DefaultReconcileMode,
+		Patches:            DefaultPatchMode,
+		IdScheme:           DefaultIdScheme,
+		tracker:            newCheckpointTracker(nil),
+		namespaced:         make(map[schema.GroupVersionResource]bool),
+		watchers:           make(map[watcherKey]*kubernetes.ResourceWatcher),
+		crds:               make(map[string]customResource),
+		namespaces:         make(map[string]bool),
+		stop:               make(chan struct{}),
 	}
 }
 
+// Run watches every resource until Stop is called, then returns once each
+// delta it received has been applied and the checkpoint has been saved.
 func (ka *KubistAgent) Run() {
-	for _, gvr := range ka.Resources {
-		client, err := ka.pool.ClientForGroupVersionResource(gvr)
+	if ka.Checkpoints != nil {
+		versions, err := ka.Checkpoints.Load()
 		if err != nil {
 			panic(err.Error())
 		}
 
-		rw := kubernetes.NewResourceWatcher(client, gvr.Resource, ka.Namespace)
-		ka.Watchers.Add(rw.Watch())
+		ka.tracker.load(versions)
+		go wait.Until(ka.saveCheckpoint, ka.CheckpointInterval, ka.stop)
 	}
 
-	for i := 0; i < ka.PoolSize; i += 1 {
-		go func () {
-            for delta := range ka.ch {
-                ka.applyDelta(delta)
-            }
-		}()
+	ka.mu.Lock()
+	ka.running = true
+	for _, ns := range ka.Namespaces {
+		ka.namespaces[ns] = true
 	}
+	if len(ka.Namespaces) == 0 && ka.NamespaceSelector == nil {
+		ka.namespaces[""] = true
+	}
+	ka.mu.Unlock()
 
-	ka.Watchers.Wait()
+	for _, gvr := range ka.Resources {
+		if err := ka.startResource(gvr); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if ka.NamespaceSelector != nil {
+		if err := ka.watchNamespaces(); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if ka.WatchCRDs {
+		if err := ka.watchCRDs(); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	ka.mu.Lock()
+	ka.started = true
+	ka.mu.Unlock()
+
+	// returns once the watchers are stopped and ka.ch is drained
+	ka.process()
+
+	if ka.Checkpoints != nil {
+		ka.saveCheckpoint()
+	}
 
 	fmt.Println("bye felicia")
 }
 
+// Returns true if gvr is namespaced, asking the API server the first time.
+func (ka *KubistAgent) isNamespaced(gvr schema.GroupVersionResource) (bool, error) {
+	ka.mu.Lock()
+	namespaced, known := ka.namespaced[gvr]
+	ka.mu.Unlock()
+
+	if known {
+		return namespaced, nil
+	} else if ka.Discovery == nil {
+		return true, nil
+	}
+
+	namespaced, err := kubernetes.IsNamespaced(ka.Discovery, gvr)
+	if err != nil {
+		return false, err
+	}
+
+	ka.mu.Lock()
+	ka.namespaced[gvr] = namespaced
+	ka.mu.Unlock()
+	return namespaced, nil
+}
+
+// Returns true if gvr is configured, or defined by a watched CRD. Must be
+// called with ka.mu held.
+func (ka *KubistAgent) watchesResource(gvr schema.GroupVersionResource) bool {
+	for _, r := range ka.Resources {
+		if r == gvr {
+			return true
+		}
+	}
+
+	for _, cr := range ka.crds {
+		if cr.Resource == gvr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the watched namespaces, sorted.
+func (ka *KubistAgent) watchedNamespaces() []string {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	namespaces := make([]string, 0, len(ka.namespaces))
+	for ns := range ka.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Start watching gvr in every watched namespace, or cluster-wide if gvr
+// isn't namespaced.
+func (ka *KubistAgent) startResource(gvr schema.GroupVersionResource) error {
+	namespaced, err := ka.isNamespaced(gvr)
+	if err != nil {
+		return err
+	} else if !namespaced {
+		return ka.startWatcher(gvr, "")
+	}
+
+	for _, ns := range ka.watchedNamespaces() {
+		if err := ka.startWatcher(gvr, ns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop every watcher for gvr, returning the namespaces it was watched in.
+// Deltas the watchers already sent are still applied.
+func (ka *KubistAgent) stopResource(gvr schema.GroupVersionResource) []string {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	var namespaces []string
+	for key, rw := range ka.watchers {
+		if key.Resource == gvr {
+			rw.Stop()
+			delete(ka.watchers, key)
+			namespaces = append(namespaces, key.Namespace)
+		}
+	}
+
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Start watching gvr in namespace, or cluster-wide if gvr isn't namespaced,
+// unless it's already watched, it's no longer wanted, or the agent has been
+// stopped.
+func (ka *KubistAgent) startWatcher(gvr schema.GroupVersionResource, namespace string) error {
+	namespaced, err := ka.isNamespaced(gvr)
+	if err != nil {
+		return err
+	} else if !namespaced {
+		namespace = ""
+	}
+
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	key := watcherKey{gvr, namespace}
+	if _, exists := ka.watchers[key]; exists {
+		return nil
+	}
+
+	// the namespace or CRD may have gone away since this was called
+	if namespaced && !ka.namespaces[namespace] || !ka.watchesResource(gvr) {
+		return nil
+	}
+
+	select {
+	case <-ka.stop:
+		return nil
+	default:
+	}
+
+	client, err := ka.pool.ClientForGroupVersionResource(gvr)
+	if err != nil {
+		return err
+	}
+
+	rw := kubernetes.NewResourceWatcher(client, gvr, namespaced, namespace)
+	rw.Selectors = ka.Selectors[gvr]
+	if rv := ka.tracker.version(checkpointKey(gvr, namespace)); rv != "" {
+		fmt.Printf("[~] Resuming %s from resourceVersion %s\n", checkpointKey(gvr, namespace), rv)
+		rw.ResumeFrom = rv
+	}
+
+	rw.OnList = func(list kubernetes.ListResult) {
+		go ka.reconcile(list)
+	}
+
+	restarts := watchRestarts.WithLabelValues(ka.Cluster, gvr.Group, gvr.Version, gvr.Resource, namespace)
+	rw.OnRestart = restarts.Inc
+
+	if err := ka.Watchers.Add(rw.Watch()); err != nil {
+		rw.Stop()
+		return nil // stopped
+	}
+
+	ka.watchers[key] = rw
+	return nil
+}
+
+// Stop every watcher. Deltas that were already received are still applied
+// before Run returns.
 func (ka *KubistAgent) Stop() {
-    ka.Watchers.Stop()
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	ka.stopOnce.Do(func() {
+		close(ka.stop)
+	})
+
+	if ka.crdWatcher != nil {
+		ka.crdWatcher.Stop()
+	}
+
+	if ka.nsWatcher != nil {
+		ka.nsWatcher.Stop()
+	}
+
+	for _, rw := range ka.watchers {
+		rw.Stop()
+	}
+
+	ka.Watchers.Stop()
+}
+
+// Returns true if Run has been called, and Stop hasn't.
+func (ka *KubistAgent) isRunning() bool {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	select {
+	case <-ka.stop:
+		return false
+	default:
+		return ka.running
+	}
+}
+
+// Save the checkpoint, if it changed since it was last saved.
+func (ka *KubistAgent) saveCheckpoint() {
+	versions := ka.tracker.changes()
+	if versions == nil {
+		return
+	}
+
+	if err := ka.Checkpoints.Save(versions); err != nil {
+		fmt.Printf("[!] Saving checkpoint: %s\n", err.Error())
+		ka.tracker.unsaved()
+	}
+}
+
+// Process deltas from ka.ch until it is closed. Deltas are sharded across
+// PoolSize workers by document id, so all changes to one object are applied
+// in order by the same worker, while other objects proceed in parallel.
+func (ka *KubistAgent) process() {
+	wg := &sync.WaitGroup{}
+	shards := make([]chan *trackedDelta, ka.PoolSize)
+	for i := range shards {
+		shards[i] = make(chan *trackedDelta, ka.BatchSize)
+
+		wg.Add(1)
+		go func(ch <-chan *trackedDelta) {
+			defer wg.Done()
+			ka.work(ch)
+		}(shards[i])
+	}
+
+	for delta := range ka.ch {
+		// a written document has already been through the pipeline
+		written := delta.DocumentId != ""
+
+		unwrapErr := ka.unwrapDeleted(&delta)
+		if !written {
+			ka.labelCluster(delta)
+			ka.prune(delta)
+			ka.redact(delta)
+		}
+
+		td := ka.tracker.track(delta)
+		deltasReceived.WithLabelValues(
+			ka.Cluster,
+			delta.Resource.Group,
+			delta.Resource.Version,
+			delta.Resource.Resource,
+			string(delta.Type),
+		).Inc()
+
+		err := unwrapErr
+		if err == nil && !written {
+			err = ka.transform(delta)
+		}
+		var id string
+		if err == nil {
+			id, err = ka.documentId(delta)
+		}
+
+		if err != nil {
+			ka.deadLetter(delta, deadLetterInvalid, err)
+			ka.tracker.applied(td)
+			continue
+		}
+
+		shards[shardFor(id, len(shards))] <- td
+	}
+
+	for _, ch := range shards {
+		close(ch)
+	}
+	wg.Wait()
+}
+
+func shardFor(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Collect deltas from ch into batches, applying each batch once it is full
+// or once BatchInterval has passed since its first delta arrived.
+func (ka *KubistAgent) work(ch <-chan *trackedDelta) {
+	tracked := make([]*trackedDelta, 0, ka.BatchSize)
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if len(tracked) > 0 {
+			deltas := make([]kubernetes.ResourceDelta, len(tracked))
+			for i, td := range tracked {
+				deltas[i] = td.ResourceDelta
+			}
+
+			ka.applyBatch(deltas)
+			for _, td := range tracked {
+				ka.tracker.applied(td)
+			}
+			tracked = tracked[:0]
+		}
+		timeout = nil
+	}
+
+	for {
+		select {
+		case td, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+
+			if len(tracked) == 0 {
+				timeout = time.After(ka.BatchInterval)
+			}
+
+			tracked = append(tracked, td)
+			if len(tracked) >= ka.BatchSize {
+				flush()
+			}
+
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+// Apply a batch of deltas, retrying transient failures with exponential
+// backoff. Deltas that still can't be applied are sent to the dead letter
+// store instead of stopping the agent.
+func (ka *KubistAgent) applyBatch(deltas []kubernetes.ResourceDelta) {
+	var lastErr error
+	pending := deltas
+	err := wait.ExponentialBackoff(ka.Backoff, func() (bool, error) {
+		if lastErr != nil {
+			fmt.Printf("[!] Retrying %d deltas: %s\n", len(pending), lastErr.Error())
+		}
+
+		pending, lastErr = ka.tryBatch(pending)
+		return len(pending) == 0, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		for _, delta := range pending {
+			ka.deadLetter(delta, deadLetterRetries, lastErr)
+		}
+	}
+}
+
+// Apply deltas in a single batch for each database, returning the deltas
+// that failed with a transient error and should be retried. Permanent
+// failures are sent to the dead letter store.
+func (ka *KubistAgent) tryBatch(deltas []kubernetes.ResourceDelta) ([]kubernetes.ResourceDelta, error) {
+	if ka.Databases == nil {
+		return ka.tryBatchIn(ka.db, deltas)
+	}
+
+	var dbs []couchdb.DatabaseInterface
+	groups := make(map[couchdb.DatabaseInterface][]kubernetes.ResourceDelta)
+
+	var retry []kubernetes.ResourceDelta
+	var retryErr error
+	for _, delta := range deltas {
+		db, err := ka.database(delta)
+		if _, reserved := err.(reservedDatabaseError); reserved {
+			ka.deadLetter(delta, deadLetterInvalid, err)
+			continue
+		} else if err != nil && !couchdb.IsTransient(err) {
+			ka.deadLetter(delta, deadLetterRejected, err)
+			continue
+		} else if err != nil {
+			retry = append(retry, delta)
+			retryErr = err
+			continue
+		}
+
+		if _, ok := groups[db]; !ok {
+			dbs = append(dbs, db)
+		}
+		groups[db] = append(groups[db], delta)
+	}
+
+	for _, db := range dbs {
+		if pending, err := ka.tryBatchIn(db, groups[db]); len(pending) > 0 {
+			retry = append(retry, pending...)
+			retryErr = err
+		}
+	}
+
+	return retry, retryErr
+}
+
+func (ka *KubistAgent) tryBatchIn(db couchdb.DatabaseInterface, deltas []kubernetes.ResourceDelta) ([]kubernetes.ResourceDelta, error) {
+	valid := make([]kubernetes.ResourceDelta, 0, len(deltas))
+	ids := make([]string, 0, len(deltas))
+	for _, delta := range deltas {
+		if id, err := ka.documentId(delta); err != nil {
+			ka.deadLetter(delta, deadLetterInvalid, err)
+		} else {
+			valid = append(valid, delta)
+			ids = append(ids, id)
+		}
+	}
+
+	// a failed request fails every delta it included
+	failAll := func(deltas []kubernetes.ResourceDelta, err error) ([]kubernetes.ResourceDelta, error) {
+		if couchdb.IsTransient(err) {
+			return deltas, err
+		}
+
+		for _, delta := range deltas {
+			ka.deadLetter(delta, deadLetterRejected, err)
+		}
+		return nil, nil
+	}
+
+	b := newBatch(db)
+	if err := b.prefetch(ids); err != nil {
+		return failAll(valid, err)
+	}
+
+	applied := make([]kubernetes.ResourceDelta, 0, len(valid))
+	byId := make(map[string][]kubernetes.ResourceDelta, len(valid))
+	for i, delta := range valid {
+		if err := ka.applyDelta(b, delta); err != nil {
+			ka.deadLetter(delta, deadLetterInvalid, err)
+		} else {
+			applied = append(applied, delta)
+			byId[ids[i]] = append(byId[ids[i]], delta)
+		}
+	}
+
+	results, err := b.flush()
+	if err != nil {
+		return failAll(applied, err)
+	}
+
+	var retry []kubernetes.ResourceDelta
+	var retryErr error
+	written := make(map[string]bool, len(results))
+	for _, result := range results {
+		if result.Ok {
+			written[result.Id] = true
+			continue
+		}
+
+		err := fmt.Errorf("%s: %s", result.Error, result.Reason)
+		if result.Conflict() {
+			// changed since it was read, so try again with the new revision
+			fmt.Printf("[!] %s: conflict writing revision\n", result.Id)
+			retry = append(retry, byId[result.Id]...)
+			retryErr = err
+		} else {
+			for _, delta := range byId[result.Id] {
+				ka.deadLetter(delta, deadLetterRejected, err)
+			}
+		}
+	}
+
+	if ka.History != nil {
+		ka.History.Record(b.changes, written)
+	}
+	ka.recordChanges(b.changes, written)
+
+	return retry, retryErr
+}
+
+func (ka *KubistAgent) deadLetter(delta kubernetes.ResourceDelta, reason string, err error) {
+	if ka.DeadLetters == nil {
+		fmt.Printf("[!] Dropped %s delta: %s\n", delta.Type, err.Error())
+		return
+	}
+
+	ka.DeadLetters.Record(delta, ka.databaseName(delta), reason, err)
+}
+
+// Replace a DeletedFinalStateUnknown tombstone, sent for an object that was
+// deleted while the watch was down, with the object it names. A tombstone
+// without one is named by its key, and the kind its resource was last
+// listed with.
+func (ka *KubistAgent) unwrapDeleted(delta *kubernetes.ResourceDelta) error {
+	t, ok := delta.Object.(cache.DeletedFinalStateUnknown)
+	if !ok {
+		return nil
+	}
+
+	kind := ""
+	ka.mu.Lock()
+	if rw := ka.watchers[watcherKey{delta.Resource, delta.Namespace}]; rw != nil {
+		kind = rw.Kind()
+	}
+	ka.mu.Unlock()
+
+	obj, err := kubernetes.TombstoneObject(t, delta.Resource, kind)
+	if err != nil {
+		return err
+	} else if obj.GetKind() == "" {
+		return fmt.Errorf("deleted %s has no kind", t.Key)
+	}
+
+	delta.Object = obj
+	delta.FinalStateUnknown = true
+	return nil
 }
 
-func (ka *KubistAgent) applyDelta(delta cache.Delta) {
-	rsrc := delta.Object.(*unstructured.Unstructured)
+// Returns the id of the document for the object in delta.
+func (ka *KubistAgent) documentId(delta kubernetes.ResourceDelta) (string, error) {
+	if delta.DocumentId != "" {
+		return delta.DocumentId, nil
+	}
+	return ka.IdScheme.DocumentId(delta.Object)
+}
+
+func (ka *KubistAgent) applyDelta(b *batch, delta kubernetes.ResourceDelta) error {
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object %T", delta.Object)
+	}
 	rv := rsrc.GetResourceVersion()
 
-	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(rsrc)
+	id, err := ka.documentId(delta)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
-	id := rsrc.GetKind() + "/" + key
 	fmt.Printf("[%s] %s rv=%s\n", delta.Type, id, rv)
 
 	action := strings.ToUpper(string(delta.Type))
 	switch delta.Type {
 	case cache.Added:
-		if doc, err := ka.db.GetOrNil(id); err != nil {
-			panic(err.Error())
+		if doc, err := b.get(id); err != nil {
+			return err
+		} else if isTombstone(doc) {
+			docRv := (&unstructured.Unstructured{Object: doc}).GetResourceVersion()
+			if older, err := olderRv(rv, docRv); err != nil {
+				return err
+			} else if older {
+				break // deleted since
+			}
 		} else if doc != nil {
-			docObject := &unstructured.Unstructured{Object: doc.Body}
+			docObject := &unstructured.Unstructured{Object: doc}
 			docRv := docObject.GetResourceVersion()
 			if docRv != rv {
 				fmt.Printf("[!] ADD %s: conflict resourceVersion %#v != %#v\n", id, rv, docRv)
+				conflicts.WithLabelValues(ka.Cluster, rsrc.GetKind(), string(delta.Type)).Inc()
 			} else {
 				fmt.Printf("[!] ADD %s: existing resourceVersion %#v\n", id, docRv)
 			}
@@ -101,59 +769,106 @@ func (ka *KubistAgent) applyDelta(delta cache.Delta) {
 		}
 
 		rsrc.Object["_id"] = id
-		_, err := ka.db.Put(id, rsrc.Object)
-		if status, ok := err.(*couchdb.StatusObject); ok {
-			fmt.Printf("[!] ADD %s: put %s\n", id, status.Status)
-		} else if err != nil {
-			panic(err.Error())
-		}
+		b.put(id, rsrc.Object)
+		b.changed(delta.Type, id, rv, rsrc.Object, nil)
 
 	case cache.Updated, cache.Sync:
 		put := rsrc.DeepCopy().Object
 		put["_id"] = id
 
-		if doc, err := ka.db.GetOrNil(id); err != nil {
-			panic(err.Error())
+		var patch []interface{}
+		if doc, err := b.get(id); err != nil {
+			return err
 		} else if doc == nil {
 			fmt.Printf("[~] %s %s: new document\n", action, id)
 		} else {
-			put["_rev"] = doc.Body["_rev"]
-
-			docObject := &unstructured.Unstructured{Object: doc.Body}
+			docObject := &unstructured.Unstructured{Object: doc}
 			docRv := docObject.GetResourceVersion()
-			if parseRv(rv) < parseRv(docRv) {
+
+			if older, err := olderRv(rv, docRv); err != nil {
+				return err
+			} else if older {
 				fmt.Printf("[!] %s %s: conflict resourceVersion %#v < %#v\n", action, id, rv, docRv)
+				conflicts.WithLabelValues(ka.Cluster, rsrc.GetKind(), string(delta.Type)).Inc()
 				break // old version, don't overwrite
 			} else if rv == docRv {
 				break // same version, don't overwrite
+			} else if ka.unchanged(doc, put) {
+				fmt.Printf("[~] %s %s: unchanged\n", action, id)
+				break
+			} else if patch, err = ka.patch(doc, put); err != nil {
+				return err
 			}
 		}
 
-		_, err = ka.db.Put(id, put)
-		if status, ok := err.(*couchdb.StatusObject); ok {
-			fmt.Printf("[!] %s %s: put %s\n", action, id, status.Status)
-		} else if err != nil {
-			panic(err.Error())
-		}
+		b.put(id, put)
+		b.changed(delta.Type, id, rv, put, patch)
 
 	case cache.Deleted:
-		if doc, err := ka.db.GetOrNil(id); err != nil {
-			panic(err.Error())
+		if doc, err := b.get(id); err != nil {
+			return err
 		} else if doc != nil {
-			if _, err := ka.db.Delete(doc.Body); err != nil {
-				fmt.Printf("[!] DELETE %s: %s\n", id, err.Error())
+			docObject := &unstructured.Unstructured{Object: doc}
+			docRv := docObject.GetResourceVersion()
+
+			// a missed delete without a resourceVersion can't be ordered
+			// against the document, which is deleted whatever its version
+			older := false
+			if rv != "" || !delta.FinalStateUnknown {
+				if older, err = olderRv(rv, docRv); err != nil {
+					return err
+				}
+			}
+
+			if older {
+				fmt.Printf("[!] DELETE %s: conflict resourceVersion %#v < %#v\n", id, rv, docRv)
+				conflicts.WithLabelValues(ka.Cluster, rsrc.GetKind(), string(delta.Type)).Inc()
+				break // recreated since, don't delete
+			}
+
+			// the document is the last known state of an object whose
+			// final state is unknown
+			final := rsrc
+			if delta.FinalStateUnknown {
+				final = docObject
+			}
+
+			if !ka.SoftDelete {
+				b.delete(id)
+				b.changed(delta.Type, id, rv, nil, nil)
+			} else if !isTombstone(doc) {
+				put := tombstone(id, final)
+				b.put(id, put)
+				b.changed(delta.Type, id, rv, put, nil)
 			}
 		}
 
 	default:
-		panic("what what in the butt")
+		return fmt.Errorf("unknown delta type %#v", delta.Type)
 	}
+
+	return nil
+}
+
+// Returns true if resourceVersion rv is older than other.
+func olderRv(rv, other string) (bool, error) {
+	a, err := parseRv(rv)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := parseRv(other)
+	if err != nil {
+		return false, err
+	}
+
+	return a < b, nil
 }
 
-func parseRv(rv string) int {
+func parseRv(rv string) (int, error) {
 	if i, err := strconv.Atoi(rv); err != nil {
-		panic(err.Error())
+		return 0, fmt.Errorf("resourceVersion %#v is not numeric", rv)
 	} else {
-		return i
+		return i, nil
 	}
 }
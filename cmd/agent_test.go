@@ -0,0 +1,559 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDatabase is an in-memory DatabaseInterface that records the order in
+// which each document was written.
+type fakeDatabase struct {
+	name   string
+	mu     sync.Mutex
+	docs   map[string]couchdb.Body
+	writes map[string][]string
+
+	// number of AllDocs requests for a range of documents
+	scans int
+
+	// maximum random delay before each bulk write, to shuffle workers
+	jitter time.Duration
+
+	// number of bulk writes to fail before succeeding
+	failures int
+}
+
+var _ couchdb.DatabaseInterface = &fakeDatabase{}
+
+func newFakeDatabase() *fakeDatabase {
+	return &fakeDatabase{
+		docs:   make(map[string]couchdb.Body),
+		writes: make(map[string][]string),
+	}
+}
+
+func (db *fakeDatabase) Name() string          { return db.name }
+func (db *fakeDatabase) Exists() (bool, error) { return true, nil }
+func (db *fakeDatabase) Create() error         { return nil }
+func (db *fakeDatabase) Drop() error           { return nil }
+
+func (db *fakeDatabase) Changes(chan<- couchdb.Body, <-chan struct{}) error {
+	return nil
+}
+
+func (db *fakeDatabase) Head(id string) (*couchdb.StatusObject, error) {
+	return db.GetOrNil(id)
+}
+
+func (db *fakeDatabase) Get(id string) (*couchdb.StatusObject, error) {
+	return db.GetOrNil(id)
+}
+
+func (db *fakeDatabase) GetOrNil(id string) (*couchdb.StatusObject, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if doc, ok := db.docs[id]; ok {
+		return &couchdb.StatusObject{Body: doc}, nil
+	}
+	return nil, nil
+}
+
+func (db *fakeDatabase) Delete(doc couchdb.Body) (*couchdb.StatusObject, error) {
+	doc["_deleted"] = true
+	return db.Post(doc)
+}
+
+func (db *fakeDatabase) Post(doc couchdb.Body) (*couchdb.StatusObject, error) {
+	results, _ := db.BulkDocs([]couchdb.Body{doc})
+	return &couchdb.StatusObject{Body: couchdb.Body{"id": results[0].Id}}, nil
+}
+
+func (db *fakeDatabase) Put(id string, doc couchdb.Body) (*couchdb.StatusObject, error) {
+	doc["_id"] = id
+	return db.Post(doc)
+}
+
+func (db *fakeDatabase) BulkDocs(docs []couchdb.Body) ([]couchdb.BulkResult, error) {
+	if db.jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(db.jitter))))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.failures > 0 {
+		db.failures--
+		return nil, &couchdb.StatusObject{Response: &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+		}}
+	}
+
+	results := make([]couchdb.BulkResult, len(docs))
+	for i, doc := range docs {
+		id := doc["_id"].(string)
+		results[i].Id = id
+
+		rev, _ := doc["_rev"].(string)
+		if existing, ok := db.docs[id]; ok && existing["_rev"] != rev {
+			results[i].Error = "conflict"
+			continue
+		} else if !ok && rev != "" {
+			results[i].Error = "conflict"
+			continue
+		}
+
+		if deleted, _ := doc["_deleted"].(bool); deleted {
+			delete(db.docs, id)
+			db.writes[id] = append(db.writes[id], "deleted")
+		} else {
+			stored := make(couchdb.Body, len(doc))
+			for k, v := range doc {
+				stored[k] = v
+			}
+			stored["_rev"] = fmt.Sprintf("%d-fake", len(db.writes[id])+1)
+			db.docs[id] = stored
+
+			rv := (&unstructured.Unstructured{Object: doc}).GetResourceVersion()
+			db.writes[id] = append(db.writes[id], rv)
+		}
+
+		results[i].Ok = true
+		results[i].Rev, _ = db.docs[id]["_rev"].(string)
+	}
+
+	return results, nil
+}
+
+func (db *fakeDatabase) AllDocs(opts couchdb.AllDocsOptions) (*couchdb.AllDocsResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	keys := opts.Keys
+	if len(keys) == 0 {
+		db.scans++
+		for id := range db.docs {
+			if id >= opts.StartKey && (opts.EndKey == "" || id <= opts.EndKey) {
+				keys = append(keys, id)
+			}
+		}
+		sort.Strings(keys)
+	}
+
+	res := &couchdb.AllDocsResult{TotalRows: len(db.docs)}
+	if len(opts.Keys) == 0 {
+		if opts.Skip < len(keys) {
+			keys = keys[opts.Skip:]
+		} else {
+			keys = nil
+		}
+		if opts.Limit > 0 && opts.Limit < len(keys) {
+			keys = keys[:opts.Limit]
+		}
+	}
+
+	for _, id := range keys {
+		row := couchdb.AllDocsRow{Id: id, Key: id}
+		if doc, ok := db.docs[id]; !ok {
+			row.Error = "not_found"
+		} else {
+			row.Value.Rev = doc["_rev"].(string)
+			if opts.IncludeDocs {
+				row.Doc = doc
+			}
+		}
+		res.Rows = append(res.Rows, row)
+	}
+
+	return res, nil
+}
+
+func newTestAgent(db couchdb.DatabaseInterface) *KubistAgent {
+	ka := NewKubistAgent(db, nil, nil, nil)
+	ka.BatchInterval = time.Millisecond
+	return ka
+}
+
+var testResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+func testDelta(t cache.DeltaType, name string, rv int) kubernetes.ResourceDelta {
+	obj := &unstructured.Unstructured{}
+	obj.SetKind("Pod")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetResourceVersion(fmt.Sprint(rv))
+
+	return kubernetes.ResourceDelta{
+		Delta:      cache.Delta{Type: t, Object: obj},
+		Resource:   testResource,
+		Checkpoint: fmt.Sprint(rv),
+	}
+}
+
+// Send deltas through the agent like its watchers do, returning once they
+// have all been applied.
+func processDeltas(ka *KubistAgent, deltas ...kubernetes.ResourceDelta) {
+	ka.ch = make(chan kubernetes.ResourceDelta, len(deltas))
+	for _, delta := range deltas {
+		ka.ch <- delta
+	}
+	close(ka.ch)
+	ka.process()
+}
+
+// Returns a delete the watcher missed, like the one it sends for an object
+// missing from a list at rv.
+func testTombstone(name string, rv int) kubernetes.ResourceDelta {
+	delta := testDelta(cache.Deleted, name, rv)
+	delta.Object = cache.DeletedFinalStateUnknown{Key: "default/" + name, Obj: delta.Object}
+	return delta
+}
+
+func TestKubistAgent_Ordering(t *testing.T) {
+	db := newFakeDatabase()
+	db.jitter = time.Millisecond
+
+	ka := newTestAgent(db)
+	ka.PoolSize = 8
+	ka.BatchSize = 1
+
+	done := make(chan struct{})
+	go func() {
+		ka.process()
+		close(done)
+	}()
+
+	// send the whole lifecycle of each pod back to back, so that any
+	// reordering between workers leaves a pod behind or writes it out of
+	// order
+	var names []string
+	for i := 0; i < 50; i++ {
+		names = append(names, fmt.Sprintf("pod-%d", i))
+	}
+
+	for i, name := range names {
+		ka.ch <- testDelta(cache.Added, name, 100+i)
+		ka.ch <- testDelta(cache.Updated, name, 200+i)
+		ka.ch <- testDelta(cache.Deleted, name, 300+i)
+	}
+
+	close(ka.ch)
+	<-done
+
+	assert.Equal(t, len(db.docs), 0, "documents left behind")
+	for i, name := range names {
+		id := "Pod/default/" + name
+		want := fmt.Sprintf("%d,%d,deleted", 100+i, 200+i)
+		assert.Equal(t, strings.Join(db.writes[id], ","), want, id)
+	}
+}
+
+func TestKubistAgent_Batching(t *testing.T) {
+	db := newFakeDatabase()
+
+	ka := newTestAgent(db)
+	ka.PoolSize = 1
+	ka.BatchSize = 10
+	ka.BatchInterval = time.Hour
+
+	done := make(chan struct{})
+	go func() {
+		ka.process()
+		close(done)
+	}()
+
+	// a full batch is flushed without waiting for the interval
+	for rv := 1; rv <= 10; rv++ {
+		ka.ch <- testDelta(cache.Updated, "pod", rv)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		db.mu.Lock()
+		writes := db.writes["Pod/default/pod"]
+		db.mu.Unlock()
+
+		if len(writes) > 0 {
+			// only the last of the coalesced deltas is written
+			assert.Equal(t, writes, []string{"10"})
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("batch was not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(ka.ch)
+	<-done
+}
+
+func TestKubistAgent_DeadLetters(t *testing.T) {
+	db := newFakeDatabase()
+	db.failures = 2
+
+	deadDb := newFakeDatabase()
+
+	ka := newTestAgent(db)
+	ka.Backoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	ka.DeadLetters = NewDeadLetterStore(deadDb)
+
+	// transient errors are retried
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 1)})
+	assert.Equal(t, db.writes["Pod/default/pod"], []string{"1"})
+	assert.Equal(t, ka.DeadLetters.Count(), uint64(0))
+
+	// permanent errors are recorded without failing the rest of the batch
+	bad := testDelta(cache.Updated, "pod", 0)
+	bad.Object.(*unstructured.Unstructured).SetResourceVersion("bogus")
+	ka.applyBatch([]kubernetes.ResourceDelta{bad, testDelta(cache.Added, "other", 2)})
+	assert.Equal(t, db.writes["Pod/default/other"], []string{"2"})
+	assert.Equal(t, ka.DeadLetters.Count(), uint64(1))
+
+	// as are transient errors that outlast the backoff
+	db.failures = 3
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Updated, "pod", 3)})
+	assert.Equal(t, db.writes["Pod/default/pod"], []string{"1"})
+	assert.Equal(t, ka.DeadLetters.Count(), uint64(2))
+
+	letters, err := ka.DeadLetters.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(letters), 2)
+	assert.Equal(t, letters[0].Delta.Type, cache.Updated)
+	assert.Equal(t, letters[0].Error, `resourceVersion "bogus" is not numeric`)
+	assert.Equal(t, letters[1].Error, "HTTP status 503 Service Unavailable")
+	assert.Equal(t, letters[0].Reason, deadLetterInvalid)
+	assert.Equal(t, letters[1].Reason, deadLetterRetries)
+	assert.Equal(t, testutil.ToFloat64(deadLetters.WithLabelValues(deadLetterRetries)) >= 1, true)
+}
+
+func TestKubistAgent_FinalStateUnknown(t *testing.T) {
+	db := newFakeDatabase()
+	deadDb := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.DeadLetters = NewDeadLetterStore(deadDb)
+
+	ka.applyBatch([]kubernetes.ResourceDelta{
+		testDelta(cache.Added, "gone", 3),
+		testDelta(cache.Added, "recreated", 12),
+	})
+
+	// missing from a list at resourceVersion 10
+	processDeltas(ka, testTombstone("gone", 10), testTombstone("recreated", 10))
+	assert.Equal(t, db.writes["Pod/default/gone"], []string{"3", "deleted"})
+	assert.Equal(t, db.writes["Pod/default/recreated"], []string{"12"})
+
+	// a tombstone with only a key takes its kind from the resource's
+	// watcher, and without one, it's a dead letter
+	processDeltas(ka, kubernetes.ResourceDelta{
+		Delta: cache.Delta{
+			Type:   cache.Deleted,
+			Object: cache.DeletedFinalStateUnknown{Key: "default/recreated", Obj: "default/recreated"},
+		},
+		Resource: testResource,
+	})
+	assert.Equal(t, db.writes["Pod/default/recreated"], []string{"12"})
+
+	letters, err := ka.DeadLetters.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(letters), 1)
+	assert.Equal(t, letters[0].Error, "deleted default/recreated has no kind")
+}
+
+func TestDeadLetterStore_Record(t *testing.T) {
+	store := NewDeadLetterStore(newFakeDatabase())
+
+	// a tombstone's object was never redacted, so only its key is kept
+	secret := map[string]interface{}{"kind": "Secret", "data": map[string]interface{}{"password": "aHVudGVyMg=="}}
+	store.Record(kubernetes.ResourceDelta{
+		Delta: cache.Delta{
+			Type:   cache.Deleted,
+			Object: cache.DeletedFinalStateUnknown{Key: "default/db", Obj: secret},
+		},
+		Resource: testResource,
+	}, "", deadLetterInvalid, errors.New("deleted default/db has no kind"))
+
+	letters, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(letters), 1)
+	assert.Equal(t, letters[0].Delta.Object, "default/db")
+}
+
+func TestCheckpointTracker(t *testing.T) {
+	tracker := newCheckpointTracker(nil)
+
+	var tracked []*trackedDelta
+	for rv := 1; rv <= 4; rv++ {
+		tracked = append(tracked, tracker.track(testDelta(cache.Updated, "pod", rv)))
+	}
+
+	// a list can't be resumed from part way through
+	list := testDelta(cache.Sync, "listed", 5)
+	list.Checkpoint = ""
+	tracked = append(tracked, tracker.track(list))
+
+	assert.Equal(t, tracker.changes() == nil, true)
+
+	// applied out of order, so only the first two are safe
+	tracker.applied(tracked[0])
+	tracker.applied(tracked[1])
+	tracker.applied(tracked[3])
+	assert.Equal(t, tracker.changes(), map[string]string{"v1/pods": "2"})
+	assert.Equal(t, tracker.changes() == nil, true)
+	assert.Equal(t, tracker.depth(), 2)
+
+	tracker.applied(tracked[4])
+	assert.Equal(t, tracker.changes() == nil, true)
+
+	tracker.applied(tracked[2])
+	assert.Equal(t, tracker.changes(), map[string]string{"v1/pods": "4"})
+	assert.Equal(t, tracker.depth(), 0)
+
+	// each namespace is checkpointed on its own
+	other := testDelta(cache.Updated, "pod", 3)
+	other.Namespace = "other"
+	tracker.applied(tracker.track(other))
+	assert.Equal(t, tracker.changes(), map[string]string{"v1/pods": "4", "v1/pods@other": "3"})
+}
+
+func TestKubistAgent_findOrphans(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+
+	docs := []struct {
+		namespace, name, apiVersion string
+		rv                          int
+	}{
+		{"default", "listed", "v1", 5},
+		{"default", "orphan", "v1", 5},
+		{"default", "newer", "v1", 20},
+		{"default", "other-group", "example.com/v1", 5},
+		{"other", "elsewhere", "v1", 5},
+	}
+
+	for _, d := range docs {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion(d.apiVersion)
+		obj.SetKind("Pod")
+		obj.SetNamespace(d.namespace)
+		obj.SetName(d.name)
+		obj.SetResourceVersion(fmt.Sprint(d.rv))
+		db.Put("Pod/"+d.namespace+"/"+d.name, obj.Object)
+	}
+
+	orphans, err := ka.findOrphans(kubernetes.ListResult{
+		Resource:        testResource,
+		Namespace:       "default",
+		Kind:            "Pod",
+		Keys:            map[string]bool{"default/listed": true},
+		ResourceVersion: "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(orphans), 1)
+	assert.Equal(t, orphans[0]["_id"], "Pod/default/orphan")
+}
+
+// Delete the orphans missing from list through the running agent, and wait
+// until none are left.
+func reconcileOrphans(t *testing.T, ka *KubistAgent, list kubernetes.ListResult) {
+	done := make(chan struct{})
+	go func() {
+		ka.process()
+		close(done)
+	}()
+	defer func() {
+		ka.Stop()
+		<-done
+	}()
+
+	ka.deleteOrphans(list, false)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		orphans, err := ka.findOrphans(list)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(orphans) == 0 {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d orphans left", len(orphans))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKubistAgent_deleteOrphans(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+
+	// written documents aren't transformed again, which here would give
+	// them another id
+	ka.Transformers = []Transformer{TransformerFunc(func(_ kubernetes.ResourceDelta, obj map[string]interface{}) error {
+		name, _ := getField(obj, []string{"metadata", "name"})
+		setField(obj, fmt.Sprint(name, "-v2"), []string{"metadata", "name"})
+		return nil
+	})}
+
+	orphan := testDelta(cache.Added, "web-v2", 5).Object.(*unstructured.Unstructured)
+	orphan.SetAPIVersion("v1")
+	db.Put("Pod/default/web-v2", orphan.Object)
+
+	reconcileOrphans(t, ka, kubernetes.ListResult{
+		Resource:        testResource,
+		Namespace:       "default",
+		Kind:            "Pod",
+		Keys:            map[string]bool{},
+		ResourceVersion: "10",
+	})
+
+	assert.Equal(t, db.docs["Pod/default/web-v2"] == nil, true)
+	assert.Equal(t, db.writes["Pod/default/web-v2-v2"] == nil, true)
+}
+
+func TestDocumentId(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("web")
+
+	// cluster-scoped objects have no namespace segment
+	node := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	node.SetKind("Node")
+	node.SetName("worker-1")
+
+	for obj, id := range map[*unstructured.Unstructured]string{
+		pod:  "Pod/default/web",
+		node: "Node/worker-1",
+	} {
+		actual, err := DefaultIdScheme.DocumentId(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, actual, id)
+	}
+}
@@ -2,25 +2,37 @@ package cmd
 
 import (
 	"errors"
-	"k8s.io/client-go/tools/cache"
+	"github.com/slushie/kubist-agent/kubernetes"
 	"sync"
 )
 
+// ChannelAggregator forwards deltas from any number of channels to out.
+// Once stopped, it closes out after every forwarder has returned.
 type ChannelAggregator struct {
-	wg   *sync.WaitGroup
-	stop chan struct{}
-	out  chan<- cache.Delta
+	mu      sync.Mutex
+	wg      *sync.WaitGroup
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+	out     chan<- kubernetes.ResourceDelta
 }
 
-func NewChannelAggregator(out chan<- cache.Delta) *ChannelAggregator {
-	return &ChannelAggregator{wg: &sync.WaitGroup{}, stop: make(chan struct{}), out: out}
+func NewChannelAggregator(out chan<- kubernetes.ResourceDelta) *ChannelAggregator {
+	return &ChannelAggregator{
+		wg:   &sync.WaitGroup{},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		out:  out,
+	}
 }
 
-func (ca *ChannelAggregator) Add(ch <-chan cache.Delta) error {
-	select {
-	case <-ca.stop:
+// Forward deltas from ch until it is closed or the aggregator is stopped.
+func (ca *ChannelAggregator) Add(ch <-chan kubernetes.ResourceDelta) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.stopped {
 		return errors.New("can't add channel to stopped aggregator")
-	default:
 	}
 
 	ca.wg.Add(1)
@@ -29,10 +41,17 @@ func (ca *ChannelAggregator) Add(ch <-chan cache.Delta) error {
 		for {
 			select {
 			case <-ca.stop:
-			    close(ca.out)
 				return
-			case v := <-ch:
-				ca.out <- v
+			case v, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				select {
+				case ca.out <- v:
+				case <-ca.stop:
+					return
+				}
 			}
 		}
 	}()
@@ -40,10 +59,25 @@ func (ca *ChannelAggregator) Add(ch <-chan cache.Delta) error {
 	return nil
 }
 
+// Wait until the aggregator is stopped and out is closed.
 func (ca *ChannelAggregator) Wait() {
-	ca.wg.Wait()
+	<-ca.done
 }
 
 func (ca *ChannelAggregator) Stop() {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.stopped {
+		return
+	}
+
+	ca.stopped = true
 	close(ca.stop)
+
+	go func() {
+		ca.wg.Wait()
+		close(ca.out)
+		close(ca.done)
+	}()
 }
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+)
+
+func TestChannelAggregator(t *testing.T) {
+	out := make(chan kubernetes.ResourceDelta)
+	ca := NewChannelAggregator(out)
+
+	inputs := make([]chan kubernetes.ResourceDelta, 3)
+	for i := range inputs {
+		inputs[i] = make(chan kubernetes.ResourceDelta)
+		assert.Equal(t, ca.Add(inputs[i]), nil)
+	}
+
+	for i, ch := range inputs {
+		go func(ch chan<- kubernetes.ResourceDelta, rv int) {
+			ch <- testDelta(cache.Updated, "pod", rv)
+		}(ch, i+1)
+	}
+
+	for range inputs {
+		select {
+		case <-out:
+		case <-time.After(time.Second):
+			t.Fatal("delta was not forwarded")
+		}
+	}
+
+	// a closed input doesn't close out
+	close(inputs[0])
+
+	// stopping with inputs still open closes out exactly once
+	ca.Stop()
+	ca.Stop()
+
+	select {
+	case _, ok := <-out:
+		assert.Equal(t, ok, false)
+	case <-time.After(time.Second):
+		t.Fatal("out was not closed")
+	}
+
+	ca.Wait()
+	assert.Equal(t, ca.Add(make(chan kubernetes.ResourceDelta)) != nil, true)
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"github.com/slushie/kubist-agent/couchdb"
+	"k8s.io/client-go/tools/cache"
+)
+
+// A batch coalesces the writes for a group of deltas, so they can be sent
+// to CouchDB with a single _bulk_docs request. Only the final state of each
+// document is written, no matter how many deltas touched it.
+type batch struct {
+	db      couchdb.DatabaseInterface
+	entries map[string]*batchEntry
+	order   []string
+	changes []change
+}
+
+type batchEntry struct {
+	rev   string       // revision stored in CouchDB before this batch
+	doc   couchdb.Body // current document, nil if missing or deleted
+	dirty bool
+}
+
+// A change is the effect of one delta on a document. Every change in a batch
+// is kept for the history, even when a later one replaces it.
+type change struct {
+	Type            cache.DeltaType
+	Id              string
+	ResourceVersion string
+	Doc             couchdb.Body  // nil if deleted
+	Patch           []interface{} // from the previous document, if kept
+}
+
+func newBatch(db couchdb.DatabaseInterface) *batch {
+	return &batch{db: db, entries: make(map[string]*batchEntry)}
+}
+
+// Returns the current document for id, including any changes made earlier in
+// this batch, or nil if there is no such document.
+func (b *batch) get(id string) (couchdb.Body, error) {
+	e, err := b.entry(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.doc, nil
+}
+
+// Look up the current documents for ids with a single request, instead of
+// fetching each one as it is needed.
+func (b *batch) prefetch(ids []string) error {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := b.entries[id]; !ok {
+			b.entries[id] = nil // dedupe until the lookup fills it in
+			keys = append(keys, id)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	res, err := b.db.AllDocs(couchdb.AllDocsOptions{Keys: keys, IncludeDocs: true})
+	if err != nil {
+		for _, id := range keys {
+			delete(b.entries, id)
+		}
+		return err
+	}
+
+	for _, row := range res.Rows {
+		e := &batchEntry{}
+		if row.Error == "" && !row.Value.Deleted && row.Doc != nil {
+			e.doc = row.Doc
+			e.rev = row.Value.Rev
+		}
+		b.entries[row.Key] = e
+	}
+
+	return nil
+}
+
+func (b *batch) put(id string, doc couchdb.Body) {
+	e := b.mark(id)
+	e.doc = doc
+}
+
+func (b *batch) delete(id string) {
+	e := b.mark(id)
+	e.doc = nil
+}
+
+// Record a change made by put or delete.
+func (b *batch) changed(t cache.DeltaType, id, rv string, doc couchdb.Body, patch []interface{}) {
+	b.changes = append(b.changes, change{t, id, rv, doc, patch})
+}
+
+func (b *batch) entry(id string) (*batchEntry, error) {
+	if e := b.entries[id]; e != nil {
+		return e, nil
+	}
+
+	e := &batchEntry{}
+	if status, err := b.db.GetOrNil(id); err != nil {
+		return nil, err
+	} else if status != nil {
+		e.doc = status.Body
+		e.rev, _ = status.Body["_rev"].(string)
+	}
+
+	b.entries[id] = e
+	return e, nil
+}
+
+func (b *batch) mark(id string) *batchEntry {
+	e := b.entries[id]
+	if e == nil {
+		// written without being read, so assume it's a new document
+		e = &batchEntry{}
+		b.entries[id] = e
+	}
+
+	if !e.dirty {
+		e.dirty = true
+		b.order = append(b.order, id)
+	}
+
+	return e
+}
+
+// Returns the documents to be written, in the order they were first changed.
+func (b *batch) docs() []couchdb.Body {
+	docs := make([]couchdb.Body, 0, len(b.order))
+	for _, id := range b.order {
+		e := b.entries[id]
+
+		var doc couchdb.Body
+		if e.doc != nil {
+			doc = make(couchdb.Body, len(e.doc)+1)
+			for k, v := range e.doc {
+				doc[k] = v
+			}
+			delete(doc, "_rev")
+		} else if e.rev != "" {
+			doc = couchdb.Body{"_deleted": true}
+		} else {
+			continue // never existed, nothing to delete
+		}
+
+		doc["_id"] = id
+		if e.rev != "" {
+			doc["_rev"] = e.rev
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs
+}
+
+// Write all changed documents. The results hold the outcome for each
+// document, so one conflict doesn't fail the whole batch.
+func (b *batch) flush() ([]couchdb.BulkResult, error) {
+	docs := b.docs()
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	return b.db.BulkDocs(docs)
+}
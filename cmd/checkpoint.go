@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strings"
+	"sync"
+)
+
+// The _local document holding the last applied resourceVersion for each
+// resource. Local documents aren't replicated, so each database keeps its
+// own checkpoint.
+const checkpointId = "_local/kubist-checkpoint"
+
+// CheckpointStore persists the resourceVersion each watch can resume from.
+type CheckpointStore struct {
+	mu  sync.Mutex
+	db  couchdb.DatabaseInterface
+	id  string
+	rev string
+}
+
+// Returns a store for the checkpoint of cluster, which can be empty if
+// it's the only cluster in the database.
+func NewCheckpointStore(db couchdb.DatabaseInterface, cluster string) *CheckpointStore {
+	id := checkpointId
+	if cluster != "" {
+		id += "@" + cluster
+	}
+	return &CheckpointStore{db: db, id: id}
+}
+
+// Returns the checkpointed resourceVersions, keyed by checkpointKey.
+func (s *CheckpointStore) Load() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := make(map[string]string)
+
+	status, err := s.db.GetOrNil(s.id)
+	if err != nil || status == nil {
+		return versions, err
+	}
+
+	s.rev, _ = status.Body["_rev"].(string)
+	if resources, ok := status.Body["resources"].(map[string]interface{}); ok {
+		for k, v := range resources {
+			if rv, ok := v.(string); ok {
+				versions[k] = rv
+			}
+		}
+	}
+
+	return versions, nil
+}
+
+func (s *CheckpointStore) Save(versions map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc := couchdb.Body{"resources": versions}
+	if s.rev != "" {
+		doc["_rev"] = s.rev
+	}
+
+	status, err := s.db.Put(s.id, doc)
+	if err != nil {
+		return err
+	}
+
+	s.rev, _ = status.Body["rev"].(string)
+	return nil
+}
+
+// Returns the key for gvr in a checkpoint, like "apps/v1/deployments", or
+// "v1/pods" for the core group.
+func resourceKey(gvr schema.GroupVersionResource) string {
+	return strings.TrimPrefix(gvr.Group+"/"+gvr.Version+"/"+gvr.Resource, "/")
+}
+
+// Returns the key for a watch of gvr in namespace, like "v1/pods" for a
+// cluster-wide watch or "v1/pods@default" for one namespace.
+func checkpointKey(gvr schema.GroupVersionResource, namespace string) string {
+	if namespace == "" {
+		return resourceKey(gvr)
+	}
+	return resourceKey(gvr) + "@" + namespace
+}
+
+func parseResourceKey(key string) schema.GroupVersionResource {
+	parts := strings.Split(key, "/")
+	if len(parts) == 2 {
+		parts = append([]string{""}, parts...)
+	} else if len(parts) != 3 {
+		return schema.GroupVersionResource{}
+	}
+
+	return schema.GroupVersionResource{
+		Group:    parts[0],
+		Version:  parts[1],
+		Resource: parts[2],
+	}
+}
+
+// A checkpointTracker follows each delta from when it is received until it
+// is applied, to find the newest resourceVersion for each watch that every
+// earlier delta has been applied up to.
+type checkpointTracker struct {
+	mu       sync.Mutex
+	pending  map[string][]*trackedDelta
+	versions map[string]string
+	dirty    bool
+}
+
+type trackedDelta struct {
+	kubernetes.ResourceDelta
+	applied bool
+}
+
+func newCheckpointTracker(versions map[string]string) *checkpointTracker {
+	if versions == nil {
+		versions = make(map[string]string)
+	}
+
+	return &checkpointTracker{
+		pending:  make(map[string][]*trackedDelta),
+		versions: versions,
+	}
+}
+
+// Replace the checkpointed versions with versions loaded from a store.
+func (t *checkpointTracker) load(versions map[string]string) {
+	if versions == nil {
+		versions = make(map[string]string)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.versions = versions
+	t.dirty = false
+}
+
+// Returns the checkpointed resourceVersion for the checkpoint key.
+func (t *checkpointTracker) version(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.versions[key]
+}
+
+// Remove the checkpoint for the checkpoint key, so its next watch lists
+// everything.
+func (t *checkpointTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.versions[key]; exists {
+		delete(t.versions, key)
+		t.dirty = true
+	}
+}
+
+// Returns the number of deltas that are tracked but not yet applied.
+func (t *checkpointTracker) depth() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, pending := range t.pending {
+		for _, td := range pending {
+			if !td.applied {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Start tracking d. Deltas must be tracked in the order they were received.
+func (t *checkpointTracker) track(d kubernetes.ResourceDelta) *trackedDelta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	td := &trackedDelta{ResourceDelta: d}
+	key := checkpointKey(d.Resource, d.Namespace)
+	t.pending[key] = append(t.pending[key], td)
+	return td
+}
+
+// Mark td as applied, advancing the checkpoint past every applied delta
+// that was received before the oldest unapplied one.
+func (t *checkpointTracker) applied(td *trackedDelta) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	td.applied = true
+
+	key := checkpointKey(td.Resource, td.Namespace)
+	pending := t.pending[key]
+	for len(pending) > 0 && pending[0].applied {
+		if rv := pending[0].Checkpoint; rv != "" {
+			t.versions[key] = rv
+			t.dirty = true
+		}
+		pending = pending[1:]
+	}
+
+	if len(pending) == 0 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = pending
+	}
+}
+
+// Mark the versions as changed, after they failed to save.
+func (t *checkpointTracker) unsaved() {
+	t.mu.Lock()
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// Returns a copy of the checkpointed versions if they changed since the
+// last call, or nil otherwise.
+func (t *checkpointTracker) changes() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.dirty {
+		return nil
+	}
+
+	versions := make(map[string]string, len(t.versions))
+	for k, v := range t.versions {
+		versions[k] = v
+	}
+
+	t.dirty = false
+	return versions
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+)
+
+// The field holding the name of an object's cluster.
+var clusterFields = []string{"kubist", "cluster"}
+
+// A Kubernetes cluster the agent reflects, with its own watchers.
+type cluster struct {
+	// Empty if it's the only cluster, and its document ids have no prefix.
+	Name string
+	// The kubeconfig context, or empty in-cluster.
+	Context string
+	Config  *rest.Config
+}
+
+// Returns the values of clusterPlaceholders for c. {cluster} is the
+// context of a cluster without a name.
+func (c cluster) databaseValues(hostname string) databaseValues {
+	name := c.Name
+	if name == "" {
+		name = c.Context
+	}
+	return databaseValues{"hostname": hostname, "cluster": name, "context": c.Context}
+}
+
+// Returns the cluster obj is labelled with, if any.
+func objectCluster(obj map[string]interface{}) string {
+	v, _ := getField(obj, clusterFields)
+	name, _ := v.(string)
+	return name
+}
+
+// Returns the prefix of document ids for objects in cluster.
+func clusterPrefix(cluster string) string {
+	if cluster == "" {
+		return ""
+	}
+	return cluster + "/"
+}
+
+// Label the object in delta with the agent's Cluster.
+func (ka *KubistAgent) labelCluster(delta kubernetes.ResourceDelta) {
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok || ka.Cluster == "" {
+		return
+	}
+
+	setField(rsrc.Object, ka.Cluster, clusterFields)
+}
+
+// Returns the clusters to reflect: each of --contexts and --kubeconfigs,
+// and with --in-cluster, the cluster the agent runs in. Without either
+// list, there's a single cluster, named by --cluster-name if it's set.
+func createClusters(cmd *cobra.Command) []cluster {
+	contexts := getStringSlice("contexts")
+	files := getStringSlice("kubeconfigs")
+	name := viper.GetString("cluster-name")
+
+	path := viper.GetString("kubeconfig")
+	if len(contexts) == 0 && len(files) == 0 {
+		c := cluster{Name: name, Config: createKubernetesConfig(cmd)}
+		if !viper.GetBool("in-cluster") {
+			c.Context, _ = kubernetes.CurrentContext(path, overrides)
+		}
+		return []cluster{c}
+	}
+
+	var clusters []cluster
+	if viper.GetBool("in-cluster") {
+		if name == "" {
+			panic("--in-cluster with --contexts or --kubeconfigs needs --cluster-name")
+		}
+		clusters = append(clusters, cluster{Name: name, Config: createKubernetesConfig(cmd)})
+	}
+
+	for _, context := range contexts {
+		o := *overrides
+		o.CurrentContext = context
+
+		config, err := kubernetes.NewClientConfig(path, &o)
+		if err != nil {
+			panic(fmt.Sprintf("context %#v failed: %s", context, err.Error()))
+		}
+		clusters = append(clusters, cluster{Name: context, Context: context, Config: config})
+	}
+
+	for _, file := range files {
+		context, err := kubernetes.CurrentContext(file, overrides)
+		if err != nil {
+			panic(fmt.Sprintf("kubeconfig %#v failed: %s", file, err.Error()))
+		}
+
+		config, err := kubernetes.NewClientConfig(file, overrides)
+		if err != nil {
+			panic(fmt.Sprintf("kubeconfig %#v failed: %s", file, err.Error()))
+		}
+		clusters = append(clusters, cluster{Name: context, Context: context, Config: config})
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range clusters {
+		if c.Name == "" {
+			panic("every cluster needs a name, but a kubeconfig has no current context")
+		} else if seen[c.Name] {
+			panic(fmt.Sprintf("cluster %#v is reflected twice", c.Name))
+		}
+		seen[c.Name] = true
+	}
+
+	return clusters
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestKubistAgent_Cluster(t *testing.T) {
+	db := newFakeDatabase()
+
+	agents := make(map[string]*KubistAgent)
+	for _, name := range []string{"east", "west"} {
+		ka := newTestAgent(db)
+		ka.Cluster = name
+		agents[name] = ka
+
+		delta := testDelta(cache.Added, "pod", 1)
+		ka.labelCluster(delta)
+		ka.applyBatch([]kubernetes.ResourceDelta{delta})
+	}
+
+	// the same object in each cluster has its own document
+	for _, name := range []string{"east", "west"} {
+		doc := db.docs[name+"/Pod/default/pod"]
+		assert.Equal(t, objectCluster(doc), name)
+	}
+
+	// only the agent's own cluster is reconciled
+	orphans, err := agents["east"].findOrphans(kubernetes.ListResult{
+		Resource:        testResource,
+		Namespace:       "default",
+		Kind:            "Pod",
+		Keys:            map[string]bool{},
+		ResourceVersion: "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(orphans), 1)
+	assert.Equal(t, orphans[0]["_id"], "east/Pod/default/pod")
+
+	// deleting an orphan, or replaying a dead letter, finds the document by
+	// the cluster it's labelled with
+	newTestAgent(db).applyBatch([]kubernetes.ResourceDelta{{
+		Delta: cache.Delta{
+			Type:   cache.Deleted,
+			Object: &unstructured.Unstructured{Object: orphans[0]},
+		},
+		Resource: testResource,
+	}})
+
+	_, exists := db.docs["east/Pod/default/pod"]
+	assert.Equal(t, exists, false)
+	_, exists = db.docs["west/Pod/default/pod"]
+	assert.Equal(t, exists, true)
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+var crdResource = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1beta1",
+	Resource: "customresourcedefinitions",
+}
+
+// A customResource is the resource defined by a CustomResourceDefinition.
+type customResource struct {
+	Resource    schema.GroupVersionResource
+	Kind        string
+	Namespaced  bool
+	Established bool
+}
+
+// Returns the resource defined by a CustomResourceDefinition object.
+func parseCustomResource(crd *unstructured.Unstructured) customResource {
+	group, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	plural, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	kind, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	scope, _ := unstructured.NestedString(crd.Object, "spec", "scope")
+
+	version, _ := unstructured.NestedString(crd.Object, "spec", "version")
+	if versions, ok := unstructured.NestedSlice(crd.Object, "spec", "versions"); ok {
+		// newer servers list every version, use the first one served
+		for _, v := range versions {
+			if v, ok := v.(map[string]interface{}); ok && v["served"] == true {
+				version, _ = v["name"].(string)
+				break
+			}
+		}
+	}
+
+	cr := customResource{
+		Resource:   schema.GroupVersionResource{Group: group, Version: version, Resource: plural},
+		Kind:       kind,
+		Namespaced: scope == "Namespaced",
+	}
+
+	conditions, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		if c, ok := c.(map[string]interface{}); ok &&
+			c["type"] == "Established" && c["status"] == "True" {
+			cr.Established = true
+		}
+	}
+
+	return cr
+}
+
+// Watch CustomResourceDefinitions, starting and stopping a watcher for each
+// custom resource that matches CRDFilter.
+func (ka *KubistAgent) watchCRDs() error {
+	client, err := ka.pool.ClientForGroupVersionResource(crdResource)
+	if err != nil {
+		return err
+	}
+
+	rw := kubernetes.NewResourceWatcher(client, crdResource, false, "")
+
+	ka.mu.Lock()
+	select {
+	case <-ka.stop:
+		ka.mu.Unlock()
+		return nil
+	default:
+		ka.crdWatcher = rw
+	}
+	ka.mu.Unlock()
+
+	ch := rw.Watch()
+	go func() {
+		for delta := range ch {
+			ka.handleCRD(delta.Delta)
+		}
+	}()
+
+	return nil
+}
+
+func (ka *KubistAgent) handleCRD(delta cache.Delta) {
+	if delta.Type == cache.Deleted {
+		name := ""
+		rv := ""
+		switch obj := delta.Object.(type) {
+		case cache.DeletedFinalStateUnknown:
+			name = obj.Key
+		case *unstructured.Unstructured:
+			name = obj.GetName()
+			rv = obj.GetResourceVersion()
+		}
+
+		ka.removeCRD(name, rv)
+		return
+	}
+
+	crd, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	cr := parseCustomResource(crd)
+	if !cr.Established || !ka.CRDFilter.Matches(cr.Resource) {
+		return
+	}
+
+	ka.mu.Lock()
+	old, exists := ka.crds[crd.GetName()]
+	ka.crds[crd.GetName()] = cr
+	ka.namespaced[cr.Resource] = cr.Namespaced
+	ka.mu.Unlock()
+
+	if exists && old.Resource == cr.Resource {
+		return
+	} else if exists {
+		// the served version changed
+		ka.stopResource(old.Resource)
+	}
+
+	fmt.Printf("[+] CRD %s established, watching %s\n", crd.GetName(), resourceKey(cr.Resource))
+	if err := ka.startResource(cr.Resource); err != nil {
+		fmt.Printf("[!] CRD %s: %s\n", crd.GetName(), err.Error())
+	}
+}
+
+// Stop watching the resource defined by a deleted CRD. Documents for it are
+// deleted if CleanupCRDs is set, unless they're newer than rv.
+func (ka *KubistAgent) removeCRD(name, rv string) {
+	ka.mu.Lock()
+	cr, exists := ka.crds[name]
+	delete(ka.crds, name)
+	ka.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	fmt.Printf("[+] CRD %s deleted, no longer watching %s\n", name, resourceKey(cr.Resource))
+	for _, namespace := range ka.stopResource(cr.Resource) {
+		// a CRD with the same name starts over with a full list
+		ka.tracker.forget(checkpointKey(cr.Resource, namespace))
+
+		if ka.CleanupCRDs {
+			go ka.deleteOrphans(kubernetes.ListResult{
+				Resource:        cr.Resource,
+				Namespace:       namespace,
+				Kind:            cr.Kind,
+				ResourceVersion: rv,
+			}, false)
+		}
+	}
+}
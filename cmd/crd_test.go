@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+)
+
+func TestParseCustomResource(t *testing.T) {
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"group":   "example.com",
+			"version": "v1alpha1",
+			"scope":   "Namespaced",
+			"names": map[string]interface{}{
+				"plural": "widgets",
+				"kind":   "Widget",
+			},
+		},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "NamesAccepted", "status": "True"},
+				map[string]interface{}{"type": "Established", "status": "False"},
+			},
+		},
+	}}
+
+	widgets := schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "widgets"}
+	assert.Equal(t, parseCustomResource(crd), customResource{
+		Resource:   widgets,
+		Kind:       "Widget",
+		Namespaced: true,
+	})
+
+	unstructured.SetNestedSlice(crd.Object, []interface{}{
+		map[string]interface{}{"type": "Established", "status": "True"},
+	}, "status", "conditions")
+	unstructured.SetNestedSlice(crd.Object, []interface{}{
+		map[string]interface{}{"name": "v1alpha1", "served": false},
+		map[string]interface{}{"name": "v1beta1", "served": true},
+	}, "spec", "versions")
+
+	widgets.Version = "v1beta1"
+	assert.Equal(t, parseCustomResource(crd), customResource{
+		Resource:    widgets,
+		Kind:        "Widget",
+		Namespaced:  true,
+		Established: true,
+	})
+}
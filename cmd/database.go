@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Placeholders in a database template, which name the databases documents
+// are written to. Each cluster has its own values for clusterPlaceholders,
+// while objectPlaceholders put each namespace, or each resource, in a
+// database of its own.
+var (
+	clusterPlaceholders = []string{"hostname", "cluster", "context"}
+	objectPlaceholders  = []string{"namespace", "group", "version", "resource"}
+)
+
+// Names the database after the hostname, like earlier versions did.
+var DefaultDatabaseTemplate = "kubist/{hostname}"
+
+// The {namespace} of cluster-scoped objects, which can't be the name of a
+// namespace.
+const clusterScopedNamespace = "_cluster"
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// A DatabaseTemplate names databases by replacing placeholders like
+// {cluster} or {namespace} with their values.
+type DatabaseTemplate string
+
+// The value for each placeholder in a DatabaseTemplate.
+type databaseValues map[string]string
+
+func ParseDatabaseTemplate(s string) (DatabaseTemplate, error) {
+	known := append(append([]string{}, clusterPlaceholders...), objectPlaceholders...)
+	for _, p := range placeholderPattern.FindAllString(s, -1) {
+		if !containsString(known, p[1:len(p)-1]) {
+			sort.Strings(known)
+			return "", fmt.Errorf("unknown placeholder %s in database %#v, expected one of {%s}",
+				p, s, strings.Join(known, "}, {"))
+		}
+	}
+
+	t := DatabaseTemplate(s)
+	if t.home() == "" {
+		return "", fmt.Errorf("database %#v must start with a name that doesn't depend on the object", s)
+	}
+	return t, nil
+}
+
+// Returns true if objects are written to more than one database.
+func (t DatabaseTemplate) PerObject() bool {
+	for _, p := range objectPlaceholders {
+		if strings.Contains(string(t), "{"+p+"}") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the database for values.
+func (t DatabaseTemplate) Name(values databaseValues) string {
+	return render(string(t), values)
+}
+
+// Returns the name of the database for the agent's own documents, like its
+// checkpoint, which is named by the template up to the first placeholder
+// that depends on the object. The dead letter, history and changes
+// databases are named after it.
+func (t DatabaseTemplate) Home(values databaseValues) string {
+	return render(t.home(), values)
+}
+
+func (t DatabaseTemplate) home() string {
+	s := string(t)
+	end := len(s)
+	for _, p := range objectPlaceholders {
+		if i := strings.Index(s, "{"+p+"}"); i >= 0 && i < end {
+			end = i
+		}
+	}
+	return strings.TrimRight(s[:end], "/-_.")
+}
+
+// Returns a pattern matching the names of the databases for values, where
+// placeholders without a value match anything.
+func (t DatabaseTemplate) pattern(values databaseValues) *regexp.Regexp {
+	s := string(t)
+	expr := "^"
+	end := 0
+	for _, loc := range placeholderPattern.FindAllStringIndex(s, -1) {
+		expr += regexp.QuoteMeta(databaseSafe(s[end:loc[0]]))
+		if v, ok := values[s[loc[0]+1:loc[1]-1]]; ok {
+			expr += regexp.QuoteMeta(databaseSafe(v))
+		} else {
+			expr += `[a-z0-9_$()+-]*`
+		}
+		end = loc[1]
+	}
+	return regexp.MustCompile(expr + regexp.QuoteMeta(databaseSafe(s[end:])) + "$")
+}
+
+func render(s string, values databaseValues) string {
+	return databaseSafe(placeholderPattern.ReplaceAllStringFunc(s, func(p string) string {
+		return values[p[1:len(p)-1]]
+	}))
+}
+
+// Returns s in lower case, with characters CouchDB doesn't allow in
+// database names, like dots, replaced by underscores.
+func databaseSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', strings.ContainsRune("_$()+-/", r):
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// Returns the values of objectPlaceholders for objects of gvr in namespace.
+func objectValues(gvr schema.GroupVersionResource, namespace string) databaseValues {
+	values := databaseValues{
+		"group":     coreGroup(gvr.Group),
+		"version":   gvr.Version,
+		"resource":  gvr.Resource,
+		"namespace": namespace,
+	}
+	if namespace == "" {
+		values["namespace"] = clusterScopedNamespace
+	}
+	return values
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A DatabaseRouter opens the database for each object, when the template
+// puts each namespace or each resource in a database of its own.
+type DatabaseRouter struct {
+	Template DatabaseTemplate
+
+	client couchdb.ClientInterface
+	values databaseValues // of clusterPlaceholders
+
+	mu  sync.Mutex
+	dbs map[string]couchdb.DatabaseInterface
+}
+
+func NewDatabaseRouter(client couchdb.ClientInterface, t DatabaseTemplate, values databaseValues) *DatabaseRouter {
+	return &DatabaseRouter{
+		Template: t,
+		client:   client,
+		values:   values,
+		dbs:      make(map[string]couchdb.DatabaseInterface),
+	}
+}
+
+// Returns true if name is one of the home database's companions, like its
+// dead letters, which a namespace or resource could share a name with.
+func (r *DatabaseRouter) companion(name string) bool {
+	home := r.Template.Home(r.values)
+	return name == deadLetterDatabaseName(home) ||
+		name == historyDatabaseName(home) ||
+		name == changesDatabaseName(home)
+}
+
+func (r *DatabaseRouter) with(values databaseValues) databaseValues {
+	merged := make(databaseValues, len(r.values)+len(values))
+	for k, v := range r.values {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return merged
+}
+
+// A database an object would be written to, but the agent uses for
+// something else.
+type reservedDatabaseError string
+
+func (e reservedDatabaseError) Error() string {
+	return fmt.Sprintf("database %s is reserved for the agent", string(e))
+}
+
+// Returns the name of the database for objects of gvr in namespace.
+func (r *DatabaseRouter) Name(gvr schema.GroupVersionResource, namespace string) string {
+	return r.Template.Name(r.with(objectValues(gvr, namespace)))
+}
+
+// Returns the database for objects of gvr in namespace, creating it the
+// first time it's needed.
+func (r *DatabaseRouter) Database(gvr schema.GroupVersionResource, namespace string) (couchdb.DatabaseInterface, error) {
+	name := r.Name(gvr, namespace)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if db, ok := r.dbs[name]; ok {
+		return db, nil
+	} else if r.companion(name) {
+		return nil, reservedDatabaseError(name)
+	}
+
+	db := r.client.Database(name)
+	if exists, err := db.Exists(); err != nil {
+		return nil, err
+	} else if !exists {
+		fmt.Println("[+] Creating database " + name)
+		if err := db.Create(); err != nil {
+			// another replica may have created it first
+			if exists, _ := db.Exists(); !exists {
+				return nil, err
+			}
+		}
+	}
+
+	r.dbs[name] = db
+	return db, nil
+}
+
+// Returns the existing databases that can hold objects of gvr in namespace,
+// in any namespace if it's empty.
+func (r *DatabaseRouter) Existing(gvr schema.GroupVersionResource, namespace string) ([]couchdb.DatabaseInterface, error) {
+	values := objectValues(gvr, namespace)
+	if gvr == (schema.GroupVersionResource{}) {
+		delete(values, "group")
+		delete(values, "version")
+		delete(values, "resource")
+	}
+	if namespace == "" {
+		delete(values, "namespace")
+	}
+
+	names, err := r.client.AllDbs()
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := r.Template.pattern(r.with(values))
+	var dbs []couchdb.DatabaseInterface
+	for _, name := range names {
+		if pattern.MatchString(name) && !r.companion(name) {
+			dbs = append(dbs, r.client.Database(name))
+		}
+	}
+	return dbs, nil
+}
+
+// Returns the database for the object in delta.
+func (ka *KubistAgent) database(delta kubernetes.ResourceDelta) (couchdb.DatabaseInterface, error) {
+	if ka.Databases == nil {
+		return ka.db, nil
+	}
+
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", delta.Object)
+	}
+	return ka.Databases.Database(delta.Resource, rsrc.GetNamespace())
+}
+
+// Returns the name of the database Databases picks for the object in delta,
+// without opening it, or empty if there's no such database.
+func (ka *KubistAgent) databaseName(delta kubernetes.ResourceDelta) string {
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if ka.Databases == nil || !ok {
+		return ""
+	}
+
+	name := ka.Databases.Name(delta.Resource, rsrc.GetNamespace())
+	if ka.Databases.companion(name) {
+		return ""
+	}
+	return name
+}
+
+// Returns the databases that can hold objects of gvr in namespace, in any
+// namespace if it's empty, or of any resource if gvr is empty.
+func (ka *KubistAgent) databases(gvr schema.GroupVersionResource, namespace string) ([]couchdb.DatabaseInterface, error) {
+	if ka.Databases == nil {
+		return []couchdb.DatabaseInterface{ka.db}, nil
+	}
+	return ka.Databases.Existing(gvr, namespace)
+}
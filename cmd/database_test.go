@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"testing"
+	"time"
+)
+
+type fakeClient map[string]*fakeDatabase
+
+func (c fakeClient) AllDbs() ([]string, error) {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c fakeClient) Database(name string) couchdb.DatabaseInterface {
+	if c[name] == nil {
+		c[name] = newFakeDatabase()
+		c[name].name = name
+	}
+	return c[name]
+}
+
+func TestDatabaseTemplate(t *testing.T) {
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	values := databaseValues{"hostname": "kubist-7d4b.local", "cluster": "Prod", "context": "prod"}
+
+	var tests = []struct {
+		template, name, home string
+		perObject            bool
+	}{
+		{DefaultDatabaseTemplate, "kubist/kubist-7d4b_local", "kubist/kubist-7d4b_local", false},
+		{"kubist/{cluster}", "kubist/prod", "kubist/prod", false},
+		{"kubist/{cluster}/{namespace}", "kubist/prod/web", "kubist/prod", true},
+		{"k8s-{context}-{resource}.{group}", "k8s-prod-deployments_apps", "k8s-prod", true},
+	}
+
+	for _, test := range tests {
+		tmpl, err := ParseDatabaseTemplate(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := databaseValues{}
+		for k, s := range values {
+			v[k] = s
+		}
+		for k, s := range objectValues(deployments, "web") {
+			v[k] = s
+		}
+
+		assert.Equal(t, tmpl.Name(v), test.name)
+		assert.Equal(t, tmpl.Home(values), test.home)
+		assert.Equal(t, tmpl.PerObject(), test.perObject)
+	}
+
+	_, err := ParseDatabaseTemplate("kubist/{pod}")
+	assert.Equal(t, err.Error(), `unknown placeholder {pod} in database "kubist/{pod}", `+
+		`expected one of {cluster}, {context}, {group}, {hostname}, {namespace}, {resource}, {version}`)
+
+	_, err = ParseDatabaseTemplate("{namespace}")
+	assert.Equal(t, err.Error(), `database "{namespace}" must start with a name that doesn't depend on the object`)
+}
+
+func TestKubistAgent_Databases(t *testing.T) {
+	client := fakeClient{}
+	tmpl, _ := ParseDatabaseTemplate("kubist/{cluster}/{namespace}")
+
+	ka := newTestAgent(client.Database("kubist/prod"))
+	ka.Databases = NewDatabaseRouter(client, tmpl, databaseValues{"cluster": "prod"})
+
+	inNamespace := func(typ cache.DeltaType, ns string, rv int) kubernetes.ResourceDelta {
+		delta := testDelta(typ, "pod", rv)
+		delta.Object.(*unstructured.Unstructured).SetNamespace(ns)
+		return delta
+	}
+
+	ka.applyBatch([]kubernetes.ResourceDelta{
+		inNamespace(cache.Added, "web", 1),
+		inNamespace(cache.Added, "db", 2),
+		inNamespace(cache.Updated, "web", 3),
+	})
+
+	assert.Equal(t, client["kubist/prod/web"].writes["Pod/web/pod"], []string{"3"})
+	assert.Equal(t, client["kubist/prod/db"].writes["Pod/db/pod"], []string{"2"})
+	assert.Equal(t, len(client["kubist/prod"].docs), 0)
+
+	// a namespace can't take the name of the agent's own databases
+	client.Database("kubist/prod/history")
+	ka.applyBatch([]kubernetes.ResourceDelta{inNamespace(cache.Added, "history", 4)})
+	assert.Equal(t, len(client["kubist/prod/history"].docs), 0)
+
+	// a cluster-wide list is reconciled in every namespace's database
+	orphans, err := ka.findOrphans(kubernetes.ListResult{
+		Resource:        testResource,
+		Kind:            "Pod",
+		Keys:            map[string]bool{"web/pod": true},
+		ResourceVersion: "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(orphans), 1)
+	assert.Equal(t, orphans[0]["_id"], "Pod/db/pod")
+}
+
+func TestDeadLetterStore_ReplayRouted(t *testing.T) {
+	client := fakeClient{}
+	tmpl, _ := ParseDatabaseTemplate("kubist/{cluster}/{namespace}")
+
+	ka := newTestAgent(client.Database("kubist/prod"))
+	ka.Databases = NewDatabaseRouter(client, tmpl, databaseValues{"cluster": "prod"})
+	ka.Backoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 1}
+	ka.DeadLetters = NewDeadLetterStore(client.Database("kubist/prod/dead-letters"))
+
+	delta := testDelta(cache.Added, "pod", 1)
+	delta.Object.(*unstructured.Unstructured).SetNamespace("web")
+	client.Database("kubist/prod/web")
+	client["kubist/prod/web"].failures = 1
+	ka.applyBatch([]kubernetes.ResourceDelta{delta})
+
+	letters, err := ka.DeadLetters.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(letters), 1)
+	assert.Equal(t, letters[0].Database, "kubist/prod/web")
+
+	// replayed in the database it was meant for
+	replay := newTestAgent(client.Database("kubist"))
+	var databases []string
+	ka.DeadLetters.Replay(letters, func(database string) *KubistAgent {
+		databases = append(databases, database)
+		replay.db = client.Database(database)
+		return replay
+	})
+
+	assert.Equal(t, databases, []string{"kubist/prod/web"})
+	assert.Equal(t, client["kubist/prod/web"].writes["Pod/web/pod"], []string{"1"})
+	assert.Equal(t, len(client["kubist/prod/dead-letters"].docs), 0)
+}
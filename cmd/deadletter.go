@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"sync/atomic"
+	"time"
+)
+
+var deadLettersCmd = &cobra.Command{
+	Use:   "dead-letters",
+	Args:  cobra.NoArgs,
+	Short: "List or replay deltas that could not be written to CouchDB",
+	Long: `List or replay deltas that could not be written to CouchDB.
+
+When the agent can't apply a delta, even after retrying, the delta is
+recorded in the "<database>/dead-letters" database along with the error
+and the time it failed. Use --replay to apply them to the database again,
+oldest first, with the flags that change how the agent writes, like
+--soft-delete, --history and --patches. Deltas that fail again are
+recorded as new dead letters.
+`,
+	Run: executeDeadLetters,
+}
+
+func init() {
+	deadLettersCmd.Flags().Bool(
+		"replay",
+		false,
+		"Apply each dead letter to the database again, then remove it",
+	)
+
+	rootCmd.AddCommand(deadLettersCmd)
+}
+
+// DeadLetterStore records deltas that could not be applied, so they can be
+// inspected and replayed later.
+type DeadLetterStore struct {
+	db    couchdb.DatabaseInterface
+	count uint64
+}
+
+// A DeadLetter is a delta recorded in a DeadLetterStore.
+type DeadLetter struct {
+	Id, Rev string
+	Delta   kubernetes.ResourceDelta
+
+	// The database the delta was meant for, if the agent routes objects to
+	// several, and it could be named.
+	Database string
+
+	Reason    string
+	Error     string
+	Timestamp time.Time
+}
+
+// Why a delta became a dead letter, which labels the dead letters metric.
+const (
+	// The delta couldn't be made into a document.
+	deadLetterInvalid = "invalid"
+	// CouchDB refused the document, or the request.
+	deadLetterRejected = "rejected"
+	// Transient failures outlasted the backoff.
+	deadLetterRetries = "retries_exhausted"
+)
+
+// Sortable, unlike time.RFC3339Nano, so dead letters are listed in order.
+const deadLetterTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+func NewDeadLetterStore(db couchdb.DatabaseInterface) *DeadLetterStore {
+	return &DeadLetterStore{db: db}
+}
+
+// Returns the name of the dead letter database for the database name.
+func deadLetterDatabaseName(name string) string {
+	return name + "/dead-letters"
+}
+
+func (s *DeadLetterStore) Record(delta kubernetes.ResourceDelta, database, reason string, err error) {
+	n := atomic.AddUint64(&s.count, 1)
+	deadLetters.WithLabelValues(reason).Inc()
+	now := time.Now().UTC().Format(deadLetterTimeFormat)
+
+	// only objects the agent could redact are kept whole
+	var object interface{}
+	switch o := delta.Object.(type) {
+	case *unstructured.Unstructured:
+		object = o.Object
+	case cache.DeletedFinalStateUnknown:
+		object = o.Key
+	default:
+		object = fmt.Sprintf("%T", o)
+	}
+
+	id := fmt.Sprintf("%s/%d", now, n)
+	doc := couchdb.Body{
+		"type":      string(delta.Type),
+		"resource":  resourceKey(delta.Resource),
+		"object":    object,
+		"reason":    reason,
+		"error":     err.Error(),
+		"timestamp": now,
+	}
+	if delta.FinalStateUnknown {
+		doc["finalStateUnknown"] = true
+	}
+	if delta.DocumentId != "" {
+		doc["documentId"] = delta.DocumentId
+	}
+	if database != "" {
+		doc["database"] = database
+	}
+
+	fmt.Printf("[!] Dead letter #%d %s: %s\n", n, delta.Type, err.Error())
+	if _, err := s.db.Put(id, doc); err != nil {
+		fmt.Printf("[!] Dead letter #%d lost: %s\n", n, err.Error())
+	}
+}
+
+// Returns the number of dead letters recorded by this process.
+func (s *DeadLetterStore) Count() uint64 {
+	return atomic.LoadUint64(&s.count)
+}
+
+// Returns every dead letter in the store, oldest first.
+func (s *DeadLetterStore) List() ([]DeadLetter, error) {
+	var letters []DeadLetter
+
+	opts := &couchdb.AllDocsOptions{IncludeDocs: true, Limit: 500}
+	for opts != nil {
+		res, err := s.db.AllDocs(*opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range res.Rows {
+			if row.Doc == nil {
+				continue
+			}
+			letters = append(letters, parseDeadLetter(row.Id, row.Value.Rev, row.Doc))
+		}
+
+		opts = opts.NextPage(res)
+	}
+
+	return letters, nil
+}
+
+func parseDeadLetter(id, rev string, doc couchdb.Body) DeadLetter {
+	dl := DeadLetter{Id: id, Rev: rev}
+
+	typ, _ := doc["type"].(string)
+	dl.Delta.Type = cache.DeltaType(typ)
+	if resource, ok := doc["resource"].(string); ok {
+		dl.Delta.Resource = parseResourceKey(resource)
+	}
+	if object, ok := doc["object"].(map[string]interface{}); ok {
+		dl.Delta.Object = &unstructured.Unstructured{Object: object}
+	} else {
+		dl.Delta.Object = doc["object"]
+	}
+
+	dl.Delta.FinalStateUnknown, _ = doc["finalStateUnknown"].(bool)
+	dl.Delta.DocumentId, _ = doc["documentId"].(string)
+	dl.Database, _ = doc["database"].(string)
+	dl.Reason, _ = doc["reason"].(string)
+	dl.Error, _ = doc["error"].(string)
+	if ts, ok := doc["timestamp"].(string); ok {
+		dl.Timestamp, _ = time.Parse(deadLetterTimeFormat, ts)
+	}
+
+	return dl
+}
+
+// Remove a dead letter from the store, once it has been handled.
+func (s *DeadLetterStore) Remove(dl DeadLetter) error {
+	_, err := s.db.Delete(couchdb.Body{"_id": dl.Id, "_rev": dl.Rev})
+	return err
+}
+
+// Apply each of letters again, in order, with the agent agentFor returns
+// for the database it was meant for, then remove it. Deltas that fail again
+// are recorded as new dead letters by the agent.
+func (s *DeadLetterStore) Replay(letters []DeadLetter, agentFor func(database string) *KubistAgent) {
+	for _, dl := range letters {
+		agentFor(dl.Database).applyBatch([]kubernetes.ResourceDelta{dl.Delta})
+		if err := s.Remove(dl); err != nil {
+			fmt.Printf("[!] Removing dead letter %s: %s\n", dl.Id, err.Error())
+		}
+	}
+}
+
+func executeDeadLetters(cmd *cobra.Command, _ []string) {
+	readConfig()
+
+	cc := createCouchDbClient(cmd)
+	name := databaseName()
+	store := NewDeadLetterStore(cc.Database(deadLetterDatabaseName(name)))
+
+	letters, err := store.List()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if replay, _ := cmd.Flags().GetBool("replay"); !replay {
+		ids := idScheme()
+		for _, dl := range letters {
+			id := dl.Delta.DocumentId
+			if id == "" {
+				id, _ = ids.DocumentId(dl.Delta.Object)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n",
+				dl.Timestamp.Format(time.RFC3339), dl.Delta.Type, id, dl.Error)
+		}
+		fmt.Printf("[~] %d dead letters in %s\n", len(letters), deadLetterDatabaseName(name))
+		return
+	}
+
+	// written like the agent would, with soft deletes, history and patches
+	home := openHomeDatabases(cc, name, patchMode(), false)
+	home.deadLetters = store
+
+	agents := make(map[string]*KubistAgent)
+	store.Replay(letters, func(database string) *KubistAgent {
+		if agents[database] == nil {
+			agent := newAgent(cc, home, databaseTemplate(), commandDatabaseValues(), nil, nil, nil)
+			if database != "" {
+				agent.db = cc.Database(database)
+				agent.Databases = nil
+			}
+			agents[database] = agent
+		}
+		return agents[database]
+	})
+
+	fmt.Printf("[+] Replayed %d dead letters, %d failed again\n",
+		len(letters), store.Count())
+}
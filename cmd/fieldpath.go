@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A FieldPath selects values in an object. Paths are dot separated fields,
+// like "spec.replicas", where "[*]" matches every item of a list,
+// "[name=GLOB]" matches the items whose name matches GLOB, "[name~=GLOB]"
+// does the same ignoring case, and "['a.b']" is a field with dots in its
+// name.
+type FieldPath struct {
+	path     string
+	segments []pathSegment
+}
+
+// One step of a FieldPath: a field of an object, or some items of a list.
+type pathSegment struct {
+	field string
+
+	all     bool   // every item
+	key     string // items where key matches pattern
+	pattern string
+	fold    bool // ignoring case, with pattern in upper case
+}
+
+func ParseFieldPath(p string) (FieldPath, error) {
+	segments, err := parsePath(p)
+	if err != nil {
+		return FieldPath{}, err
+	}
+
+	return FieldPath{path: p, segments: segments}, nil
+}
+
+func mustFieldPath(p string) FieldPath {
+	fp, err := ParseFieldPath(p)
+	if err != nil {
+		panic(err.Error())
+	}
+	return fp
+}
+
+func (fp FieldPath) String() string {
+	return fp.path
+}
+
+// Remove the values at fp from obj, which is changed in place.
+func (fp FieldPath) Drop(obj map[string]interface{}) {
+	redactPath(obj, fp.segments, RedactDrop)
+}
+
+// Parses a field path into segments.
+func parsePath(p string) ([]pathSegment, error) {
+	var segments []pathSegment
+
+	for rest := p; rest != ""; {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %#v: unclosed [", p)
+			}
+
+			seg, err := parseBracket(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("path %#v: %s", p, err.Error())
+			}
+
+			segments = append(segments, seg)
+			rest = strings.TrimPrefix(rest[end+1:], ".")
+
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %#v: empty field name", p)
+			}
+
+			segments = append(segments, pathSegment{field: rest[:end]})
+			rest = strings.TrimPrefix(rest[end:], ".")
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return segments, nil
+}
+
+func parseBracket(s string) (pathSegment, error) {
+	if s == "*" {
+		return pathSegment{all: true}, nil
+	}
+
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return pathSegment{field: s[1 : len(s)-1]}, nil
+	}
+
+	if i := strings.Index(s, "~="); i > 0 {
+		seg, err := parseBracket(s[:i] + "=" + strings.ToUpper(s[i+2:]))
+		seg.fold = true
+		return seg, err
+	}
+
+	if i := strings.IndexByte(s, '='); i > 0 {
+		pattern := s[i+1:]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return pathSegment{}, fmt.Errorf("bad pattern %#v", pattern)
+		}
+		return pathSegment{key: s[:i], pattern: pattern}, nil
+	}
+
+	return pathSegment{}, fmt.Errorf("can't parse [%s]", s)
+}
+
+// Returns true if item is selected by a list segment.
+func (seg pathSegment) matches(item interface{}) bool {
+	if seg.all {
+		return true
+	}
+
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	value, ok := m[seg.key].(string)
+	if !ok {
+		return false
+	} else if seg.fold {
+		value = strings.ToUpper(value)
+	}
+
+	matched, _ := path.Match(seg.pattern, value)
+	return matched
+}
+
+// Returns v with the values at path redacted. Objects are changed in place,
+// but lists may be replaced.
+func redactPath(v interface{}, segments []pathSegment, action RedactAction) interface{} {
+	seg, last := segments[0], len(segments) == 1
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, exists := node[seg.field]
+		if seg.field == "" || !exists {
+			break
+		}
+
+		if !last {
+			node[seg.field] = redactPath(child, segments[1:], action)
+		} else if action == RedactDrop {
+			delete(node, seg.field)
+		} else {
+			node[seg.field] = redactValue(child, action)
+		}
+
+	case []interface{}:
+		if seg.field != "" {
+			break
+		}
+
+		kept := node[:0]
+		for _, item := range node {
+			if seg.matches(item) {
+				if !last {
+					item = redactPath(item, segments[1:], action)
+				} else if action == RedactDrop {
+					continue
+				} else {
+					item = redactValue(item, action)
+				}
+			}
+			kept = append(kept, item)
+		}
+		return kept
+	}
+
+	return v
+}
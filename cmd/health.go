@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"net/http"
+	"time"
+)
+
+// A watcher that hasn't listed, watched or received an event for this long
+// is considered stuck. The reflector restarts idle watches within ten
+// minutes, so this only fails if a watch loop has stopped.
+var DefaultLivenessTimeout = 15 * time.Minute
+
+// Returns an error unless every watcher has completed its initial list, or
+// the agent is a standby waiting to lead.
+func (ka *KubistAgent) checkSynced() error {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if ka.LeaderElect && !ka.running {
+		return nil
+	} else if !ka.started {
+		return fmt.Errorf("watchers are starting")
+	}
+
+	if ka.crdWatcher != nil && !ka.crdWatcher.HasSynced() {
+		return fmt.Errorf("%s has not synced", resourceKey(crdResource))
+	}
+
+	if ka.nsWatcher != nil && !ka.nsWatcher.HasSynced() {
+		return fmt.Errorf("%s has not synced", resourceKey(namespaceResource))
+	}
+
+	for _, rw := range ka.watchers {
+		if !rw.HasSynced() {
+			return fmt.Errorf("%s has not synced", checkpointKey(rw.Resource, rw.Namespace))
+		}
+	}
+
+	return nil
+}
+
+// Returns an error if any watch loop, including the ones discovering CRDs
+// and namespaces, has not made progress within timeout.
+func (ka *KubistAgent) checkLive(timeout time.Duration) error {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if ka.crdWatcher != nil {
+		if since := time.Since(ka.crdWatcher.LastHeartbeat()); since > timeout {
+			return fmt.Errorf("%s has not progressed for %s", resourceKey(crdResource), since)
+		}
+	}
+
+	if ka.nsWatcher != nil {
+		if since := time.Since(ka.nsWatcher.LastHeartbeat()); since > timeout {
+			return fmt.Errorf("%s has not progressed for %s", resourceKey(namespaceResource), since)
+		}
+	}
+
+	for _, rw := range ka.watchers {
+		if since := time.Since(rw.LastHeartbeat()); since > timeout {
+			return fmt.Errorf("%s has not progressed for %s",
+				checkpointKey(rw.Resource, rw.Namespace), since)
+		}
+	}
+
+	return nil
+}
+
+// Returns an error unless the CouchDB server answers successfully.
+func checkCouchDb(cc *couchdb.Client) error {
+	status, err := cc.Info()
+	if err != nil {
+		return err
+	} else if status.StatusCode >= 400 {
+		return status
+	}
+
+	return nil
+}
+
+// Returns a handler that responds with 200 if every check passes, or 503
+// with the first error.
+func healthHandler(checks ...func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
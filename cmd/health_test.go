@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	ka := newTestAgent(newFakeDatabase())
+	handler := healthHandler(ka.checkSynced)
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, res.Code, http.StatusServiceUnavailable)
+
+	ka.started = true
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, res.Code, http.StatusOK)
+	assert.Equal(t, res.Body.String(), "ok\n")
+
+	// every check must pass
+	handler = healthHandler(ka.checkSynced, func() error { return errors.New("unreachable") })
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, res.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, res.Body.String(), "unreachable\n")
+}
+
+func TestHealthHandler_Standby(t *testing.T) {
+	ka := newTestAgent(newFakeDatabase())
+	ka.LeaderElect = true
+	handler := healthHandler(ka.checkSynced)
+
+	// waiting to lead
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, res.Code, http.StatusOK)
+
+	// leading, but still starting its watchers
+	ka.running = true
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, res.Code, http.StatusServiceUnavailable)
+}
+
+func TestKubistAgent_checkLive(t *testing.T) {
+	ka := newTestAgent(newFakeDatabase())
+	assert.Equal(t, ka.checkLive(time.Minute), nil)
+
+	// discovery stalling is as bad as a resource's watch stalling
+	ka.nsWatcher = &kubernetes.ResourceWatcher{Resource: namespaceResource}
+	err := ka.checkLive(time.Minute)
+	assert.Equal(t, strings.HasPrefix(err.Error(), resourceKey(namespaceResource)+" has not progressed"), true)
+}
@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/cache"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history DOCUMENT_ID",
+	Args:  cobra.ExactArgs(1),
+	Short: "Print the timeline of changes to one object",
+	Long: `Print the timeline of changes to one object.
+
+With --history, the agent records every change it writes in the
+"<database>/history" database, as a document with the id of the object's
+document followed by "@" and its resourceVersion. This command prints
+those changes, oldest first, or with --at, the object as it was at a time.
+
+It takes the id of the object's document, which follows --id-scheme and
+starts with the cluster's name when there is one.
+`,
+	Example: `  kubist-agent history Deployment/default/web
+  kubist-agent history prod-east/Deployment/default/web --at 2018-02-06T09:00:00Z`,
+	Run: executeHistory,
+}
+
+var DefaultHistoryMaxRevisions = 100
+var DefaultHistoryMaxAge = 30 * 24 * time.Hour
+
+func init() {
+	historyCmd.Flags().String(
+		"at",
+		"",
+		"Print the object as it was at this RFC 3339 time",
+	)
+
+	rootCmd.AddCommand(historyCmd)
+}
+
+// HistoryStore records every change written to a database, so earlier
+// versions of an object can be looked up later.
+type HistoryStore struct {
+	db couchdb.DatabaseInterface
+
+	// Older revisions of an object are removed once it has more than
+	// MaxRevisions, or once they're older than MaxAge. Zero means no limit.
+	MaxRevisions int
+	MaxAge       time.Duration
+
+	// Revisions are read, and expired ones deleted, in batches of up to
+	// BatchSize.
+	BatchSize int
+}
+
+// A Revision is one change to an object, recorded in a HistoryStore.
+type Revision struct {
+	Id              string
+	DocumentId      string
+	ResourceVersion string
+	Type            cache.DeltaType
+	Object          map[string]interface{} // nil if deleted
+	Timestamp       time.Time
+
+	rev string
+}
+
+func NewHistoryStore(db couchdb.DatabaseInterface) *HistoryStore {
+	return &HistoryStore{
+		db:           db,
+		MaxRevisions: DefaultHistoryMaxRevisions,
+		MaxAge:       DefaultHistoryMaxAge,
+		BatchSize:    DefaultBatchSize,
+	}
+}
+
+// Returns the name of the history database for the database name.
+func historyDatabaseName(name string) string {
+	return name + "/history"
+}
+
+// Record the changes to documents that were written. Changes that were
+// already recorded, by an earlier attempt, are left alone.
+func (s *HistoryStore) Record(changes []change, written map[string]bool) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var docs []couchdb.Body
+	for _, c := range changes {
+		if !written[c.Id] {
+			continue
+		}
+
+		var object map[string]interface{}
+		if c.Doc != nil {
+			object = make(map[string]interface{}, len(c.Doc))
+			for k, v := range c.Doc {
+				object[k] = v
+			}
+			delete(object, "_id")
+			delete(object, "_rev")
+		}
+
+		docs = append(docs, couchdb.Body{
+			"_id":             c.Id + "@" + c.ResourceVersion,
+			"id":              c.Id,
+			"resourceVersion": c.ResourceVersion,
+			"type":            string(c.Type),
+			"object":          object,
+			"timestamp":       now,
+		})
+	}
+
+	if len(docs) == 0 {
+		return
+	}
+
+	results, err := s.db.BulkDocs(docs)
+	if err != nil {
+		fmt.Printf("[!] Recording history: %s\n", err.Error())
+		return
+	}
+
+	for _, result := range results {
+		if !result.Ok && !result.Conflict() {
+			fmt.Printf("[!] Recording history of %s: %s\n", result.Id, result.Error)
+		}
+	}
+}
+
+// Returns the revisions of the document id, oldest first.
+func (s *HistoryStore) Timeline(id string) ([]Revision, error) {
+	var revisions []Revision
+
+	opts := &couchdb.AllDocsOptions{
+		StartKey:    id + "@",
+		EndKey:      id + "@\ufff0",
+		IncludeDocs: true,
+		Limit:       500,
+	}
+
+	for opts != nil {
+		res, err := s.db.AllDocs(*opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range res.Rows {
+			if row.Doc != nil {
+				revisions = append(revisions, parseRevision(row.Id, row.Value.Rev, row.Doc))
+			}
+		}
+
+		opts = opts.NextPage(res)
+	}
+
+	sortRevisions(revisions)
+	return revisions, nil
+}
+
+func parseRevision(id, rev string, doc couchdb.Body) Revision {
+	r := Revision{Id: id, rev: rev}
+	r.DocumentId, _ = doc["id"].(string)
+	r.ResourceVersion, _ = doc["resourceVersion"].(string)
+
+	typ, _ := doc["type"].(string)
+	r.Type = cache.DeltaType(typ)
+	r.Object, _ = doc["object"].(map[string]interface{})
+
+	if ts, ok := doc["timestamp"].(string); ok {
+		r.Timestamp, _ = time.Parse(time.RFC3339Nano, ts)
+	}
+
+	return r
+}
+
+// Sort revisions by resourceVersion, which doesn't sort as a string.
+func sortRevisions(revisions []Revision) {
+	sort.SliceStable(revisions, func(i, j int) bool {
+		older, err := olderRv(revisions[i].ResourceVersion, revisions[j].ResourceVersion)
+		if err != nil {
+			return revisions[i].Timestamp.Before(revisions[j].Timestamp)
+		}
+		return older
+	})
+}
+
+// Remove the revisions beyond MaxRevisions or MaxAge. The newest revision
+// from before MaxAge is kept, unless it's a deletion, since it's the object
+// as it was until the next one.
+func (s *HistoryStore) Prune() {
+	if s.MaxRevisions <= 0 && s.MaxAge <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-s.MaxAge)
+
+	// revision ids start with their document's id, so each document's
+	// revisions are read one after another, and only those of the document
+	// being read are held at once
+	var revisions, expired []Revision
+	expire := func() {
+		expired = append(expired, s.expired(revisions, cutoff)...)
+		revisions = nil
+	}
+
+	opts := &couchdb.AllDocsOptions{IncludeDocs: true, Limit: s.BatchSize}
+	for opts != nil {
+		res, err := s.db.AllDocs(*opts)
+		if err != nil {
+			fmt.Printf("[!] Pruning history: %s\n", err.Error())
+			return
+		}
+
+		for _, row := range res.Rows {
+			if row.Doc == nil || strings.HasPrefix(row.Id, "_design/") {
+				continue
+			}
+
+			r := parseRevision(row.Id, row.Value.Rev, row.Doc)
+			r.Object = nil // only its type and timestamp are needed
+			if len(revisions) > 0 && revisions[0].DocumentId != r.DocumentId {
+				expire()
+			}
+			revisions = append(revisions, r)
+		}
+
+		// the next page starts after the last row, which is never deleted
+		// yet, since its document may have more revisions
+		for len(expired) >= s.BatchSize {
+			if !s.remove(expired[:s.BatchSize]) {
+				return
+			}
+			expired = expired[s.BatchSize:]
+		}
+
+		opts = opts.NextPage(res)
+	}
+
+	expire()
+	if len(expired) > 0 {
+		s.remove(expired)
+	}
+}
+
+// Returns the revisions of one document that are beyond MaxRevisions or
+// MaxAge at cutoff.
+func (s *HistoryStore) expired(revisions []Revision, cutoff time.Time) []Revision {
+	sortRevisions(revisions)
+
+	var expired []Revision
+	for i, r := range revisions {
+		superseded := i+1 < len(revisions) && revisions[i+1].Timestamp.Before(cutoff)
+
+		tooMany := s.MaxRevisions > 0 && len(revisions)-i > s.MaxRevisions
+		tooOld := s.MaxAge > 0 && r.Timestamp.Before(cutoff) && (superseded || r.Type == cache.Deleted)
+		if tooMany || tooOld {
+			expired = append(expired, r)
+		}
+	}
+
+	return expired
+}
+
+// Delete revisions, returning false if the request failed.
+func (s *HistoryStore) remove(revisions []Revision) bool {
+	docs := make([]couchdb.Body, len(revisions))
+	for i, r := range revisions {
+		docs[i] = couchdb.Body{"_id": r.Id, "_rev": r.rev, "_deleted": true}
+	}
+
+	results, err := s.db.BulkDocs(docs)
+	if err != nil {
+		fmt.Printf("[!] Pruning history: %s\n", err.Error())
+		return false
+	}
+
+	pruned := 0
+	for _, result := range results {
+		if result.Ok {
+			pruned++
+		}
+	}
+
+	fmt.Printf("[~] Pruned %d revisions from history\n", pruned)
+	return true
+}
+
+func executeHistory(cmd *cobra.Command, args []string) {
+	readConfig()
+
+	cc := createCouchDbClient(cmd)
+	name := historyDatabaseName(databaseName())
+	store := NewHistoryStore(cc.Database(name))
+
+	revisions, err := store.Timeline(args[0])
+	if err != nil {
+		panic(err.Error())
+	}
+
+	at, _ := cmd.Flags().GetString("at")
+	if at == "" {
+		for _, r := range revisions {
+			fmt.Printf("%s\t%s\t%s\n",
+				r.Timestamp.Format(time.RFC3339), r.Type, r.ResourceVersion)
+		}
+		fmt.Printf("[~] %d revisions of %s in %s\n", len(revisions), args[0], name)
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		panic("--at: " + err.Error())
+	}
+
+	var found *Revision
+	for i, r := range revisions {
+		if !r.Timestamp.After(t) {
+			found = &revisions[i]
+		}
+	}
+
+	if found == nil || found.Object == nil || isTombstone(found.Object) {
+		fmt.Printf("[!] %s didn't exist at %s\n", args[0], at)
+		os.Exit(1)
+	}
+
+	out, err := json.MarshalIndent(found.Object, "", "  ")
+	if err != nil {
+		panic(err.Error())
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+)
+
+func TestHistoryStore(t *testing.T) {
+	historyDb := newFakeDatabase()
+	ka := newTestAgent(newFakeDatabase())
+	ka.History = NewHistoryStore(historyDb)
+
+	id := "Pod/default/pod"
+	ka.applyBatch([]kubernetes.ResourceDelta{
+		testDelta(cache.Added, "pod", 9),
+		testDelta(cache.Updated, "pod", 10),
+		testDelta(cache.Added, "other", 11),
+	})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Deleted, "pod", 12)})
+
+	// every change is recorded, even when a later one in the batch replaced it
+	revisions, err := ka.History.Timeline(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []cache.DeltaType
+	var rvs []string
+	for _, r := range revisions {
+		types = append(types, r.Type)
+		rvs = append(rvs, r.ResourceVersion)
+	}
+	assert.Equal(t, types, []cache.DeltaType{cache.Added, cache.Updated, cache.Deleted})
+	assert.Equal(t, rvs, []string{"9", "10", "12"})
+	assert.Equal(t, revisions[1].Object["metadata"].(map[string]interface{})["resourceVersion"], "10")
+	assert.Equal(t, revisions[2].Object == nil, true)
+
+	// recording a change again leaves the revision alone
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 9)})
+	assert.Equal(t, len(historyDb.writes[id+"@9"]), 1)
+
+	ka.History.MaxRevisions = 2
+	ka.History.Prune()
+
+	revisions, _ = ka.History.Timeline(id)
+	assert.Equal(t, len(revisions), 2)
+	assert.Equal(t, revisions[0].ResourceVersion, "10")
+
+	revisions, _ = ka.History.Timeline("Pod/default/other")
+	assert.Equal(t, len(revisions), 1)
+}
+
+func TestHistoryStore_Reconciled(t *testing.T) {
+	ka := newTestAgent(newFakeDatabase())
+	ka.History = NewHistoryStore(newFakeDatabase())
+
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 5)})
+	reconcileOrphans(t, ka, kubernetes.ListResult{
+		Resource:        testResource,
+		Namespace:       "default",
+		Kind:            "Pod",
+		Keys:            map[string]bool{},
+		ResourceVersion: "10",
+	})
+
+	// the orphan's delete is recorded as of the list
+	revisions, err := ka.History.Timeline("Pod/default/pod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(revisions), 2)
+	assert.Equal(t, revisions[1].Type, cache.Deleted)
+	assert.Equal(t, revisions[1].ResourceVersion, "10")
+}
+
+func TestHistoryStore_PruneMaxAge(t *testing.T) {
+	historyDb := newFakeDatabase()
+	ka := newTestAgent(newFakeDatabase())
+	ka.History = NewHistoryStore(historyDb)
+	ka.History.MaxRevisions = 0
+	ka.History.MaxAge = time.Hour
+	ka.History.BatchSize = 1
+
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 1)})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Updated, "pod", 2)})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "gone", 3)})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Deleted, "gone", 4)})
+
+	// nothing has changed for two hours
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+	for _, doc := range historyDb.docs {
+		doc["timestamp"] = old
+	}
+	ka.History.Prune()
+
+	// the object as it was at the cutoff is kept
+	revisions, _ := ka.History.Timeline("Pod/default/pod")
+	assert.Equal(t, len(revisions), 1)
+	assert.Equal(t, revisions[0].ResourceVersion, "2")
+
+	// but nothing of an object deleted before it
+	revisions, _ = ka.History.Timeline("Pod/default/gone")
+	assert.Equal(t, len(revisions), 0)
+}
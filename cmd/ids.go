@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sort"
+	"strings"
+)
+
+// Placeholders in an id scheme, which are replaced with the object's values.
+var idPlaceholders = []string{"group", "version", "kind", "namespace", "name", "uid"}
+
+// An IdScheme makes the document id for an object by replacing placeholders
+// like {kind} or {uid} with the object's values. Empty segments, like the
+// {namespace} of a cluster-scoped object, are left out, and an object
+// labelled with its cluster has the cluster in front.
+type IdScheme string
+
+const (
+	// Kind/namespace/name, like earlier versions.
+	IdSchemeKind IdScheme = "{kind}/{namespace}/{name}"
+	// group/Kind/namespace/name, with "core" for the core group, for kinds
+	// served by more than one group.
+	IdSchemeGroupKind IdScheme = "{group}/{kind}/{namespace}/{name}"
+	// The object's UID, so an object that's deleted and recreated with the
+	// same name has a new document.
+	IdSchemeUID IdScheme = "{uid}"
+)
+
+// The names of the built-in schemes.
+var idSchemeNames = map[string]IdScheme{
+	"kind":       IdSchemeKind,
+	"group-kind": IdSchemeGroupKind,
+	"uid":        IdSchemeUID,
+}
+
+var DefaultIdScheme = IdSchemeKind
+
+// Returns the built-in scheme named s, or the scheme for s as a template.
+func ParseIdScheme(s string) (IdScheme, error) {
+	if scheme, ok := idSchemeNames[s]; ok {
+		return scheme, nil
+	}
+
+	for _, p := range placeholderPattern.FindAllString(s, -1) {
+		if !containsString(idPlaceholders, p[1:len(p)-1]) {
+			known := append([]string{}, idPlaceholders...)
+			sort.Strings(known)
+			return "", fmt.Errorf("unknown placeholder %s in id scheme %#v, expected one of {%s}",
+				p, s, strings.Join(known, "}, {"))
+		}
+	}
+
+	scheme := IdScheme(s)
+	if !scheme.uses("uid") && !(scheme.uses("kind") && scheme.uses("namespace") && scheme.uses("name")) {
+		return "", fmt.Errorf("id scheme %#v must be kind, group-kind, uid, or a template "+
+			"with {uid}, or with {kind}, {namespace} and {name}", s)
+	}
+	return scheme, nil
+}
+
+func (s IdScheme) uses(placeholder string) bool {
+	return strings.Contains(string(s), "{"+placeholder+"}")
+}
+
+// Returns the document id for obj.
+func (s IdScheme) DocumentId(obj interface{}) (string, error) {
+	rsrc, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", fmt.Errorf("unexpected object %T", obj)
+	}
+
+	values := idValues(rsrc)
+	for _, p := range []string{"kind", "name", "uid"} {
+		if s.uses(p) && values[p] == "" {
+			return "", fmt.Errorf("object has no %s", p)
+		}
+	}
+
+	rendered := placeholderPattern.ReplaceAllStringFunc(string(s), func(p string) string {
+		return values[p[1:len(p)-1]]
+	})
+
+	var segments []string
+	for _, segment := range strings.Split(rendered, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return clusterPrefix(objectCluster(rsrc.Object)) + strings.Join(segments, "/"), nil
+}
+
+// Returns the part of every id that starts with values, which is the
+// scheme up to the first placeholder without one.
+func (s IdScheme) prefix(values map[string]string) string {
+	str := string(s)
+	prefix := ""
+	end := 0
+	for _, loc := range placeholderPattern.FindAllStringIndex(str, -1) {
+		prefix += str[end:loc[0]]
+		v := values[str[loc[0]+1:loc[1]-1]]
+		if v == "" {
+			return prefix
+		}
+		prefix += v
+		end = loc[1]
+	}
+	return prefix + str[end:]
+}
+
+// Returns the value of each of idPlaceholders for rsrc.
+func idValues(rsrc *unstructured.Unstructured) map[string]string {
+	gv, _ := schema.ParseGroupVersion(rsrc.GetAPIVersion())
+	return map[string]string{
+		"group":     coreGroup(gv.Group),
+		"version":   gv.Version,
+		"kind":      rsrc.GetKind(),
+		"namespace": rsrc.GetNamespace(),
+		"name":      rsrc.GetName(),
+		"uid":       string(rsrc.GetUID()),
+	}
+}
+
+// Returns "core" for the core group, which is otherwise empty.
+func coreGroup(group string) string {
+	if group == "" {
+		return "core"
+	}
+	return group
+}
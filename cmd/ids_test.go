@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestIdScheme(t *testing.T) {
+	deployment := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	deployment.SetAPIVersion("apps/v1")
+	deployment.SetKind("Deployment")
+	deployment.SetNamespace("default")
+	deployment.SetName("web")
+	deployment.SetUID(types.UID("8f1c"))
+
+	node := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	node.SetAPIVersion("v1")
+	node.SetKind("Node")
+	node.SetName("worker-1")
+	node.SetUID(types.UID("2b7e"))
+	setField(node.Object, "east", clusterFields)
+
+	var tests = []struct {
+		scheme, deployment, node string
+	}{
+		{"kind", "Deployment/default/web", "east/Node/worker-1"},
+		{"group-kind", "apps/Deployment/default/web", "east/core/Node/worker-1"},
+		{"uid", "8f1c", "east/2b7e"},
+		{"k8s:{kind}.{group}/{namespace}/{name}", "k8s:Deployment.apps/default/web", "east/k8s:Node.core/worker-1"},
+	}
+
+	for _, test := range tests {
+		scheme, err := ParseIdScheme(test.scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for obj, expected := range map[*unstructured.Unstructured]string{
+			deployment: test.deployment,
+			node:       test.node,
+		} {
+			id, err := scheme.DocumentId(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, id, expected)
+		}
+	}
+
+	// ids only start with the values that come before the first one missing
+	values := map[string]string{"group": "apps", "kind": "Deployment"}
+	assert.Equal(t, IdSchemeGroupKind.prefix(values), "apps/Deployment/")
+	assert.Equal(t, IdSchemeUID.prefix(values), "")
+
+	_, err := ParseIdScheme("{kind}/{pod}")
+	assert.Equal(t, err.Error(), `unknown placeholder {pod} in id scheme "{kind}/{pod}", `+
+		`expected one of {group}, {kind}, {name}, {namespace}, {uid}, {version}`)
+
+	_, err = ParseIdScheme("{kind}/{name}")
+	assert.Equal(t, err.Error(), `id scheme "{kind}/{name}" must be kind, group-kind, uid, `+
+		`or a template with {uid}, or with {kind}, {namespace} and {name}`)
+
+	_, err = IdSchemeUID.DocumentId(&unstructured.Unstructured{Object: map[string]interface{}{}})
+	assert.Equal(t, err.Error(), "object has no uid")
+}
+
+func TestKubistAgent_IdSchemeUID(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.IdScheme = IdSchemeUID
+
+	withUID := func(typ cache.DeltaType, uid string, rv int) kubernetes.ResourceDelta {
+		delta := testDelta(typ, "pod", rv)
+		delta.Object.(*unstructured.Unstructured).SetUID(types.UID(uid))
+		return delta
+	}
+
+	// the pod was deleted and recreated while the agent wasn't watching
+	ka.applyBatch([]kubernetes.ResourceDelta{withUID(cache.Added, "old", 1)})
+	ka.applyBatch([]kubernetes.ResourceDelta{withUID(cache.Sync, "new", 5)})
+	assert.Equal(t, len(db.docs), 2)
+
+	orphans, err := ka.findOrphans(kubernetes.ListResult{
+		Resource:        testResource,
+		Namespace:       "default",
+		Kind:            "Pod",
+		Keys:            map[string]bool{"default/pod": true},
+		UIDs:            map[string]bool{"new": true},
+		ResourceVersion: "5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(orphans), 1)
+	assert.Equal(t, orphans[0]["_id"], "old")
+}
+
+func TestMigrateIds(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+
+	for i, name := range []string{"web", "db"} {
+		delta := testDelta(cache.Added, name, i+1)
+		delta.Object.(*unstructured.Unstructured).SetUID(types.UID("uid-" + name))
+		ka.applyBatch([]kubernetes.ResourceDelta{delta})
+	}
+	db.Put("_design/views", map[string]interface{}{"views": map[string]interface{}{}})
+
+	moved, err := migrateIds(db, IdSchemeUID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, moved, 2)
+	assert.Equal(t, db.docs["Pod/default/web"] != nil, true)
+
+	moved, err = migrateIds(db, IdSchemeUID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, moved, 2)
+
+	assert.Equal(t, len(db.docs), 3)
+	assert.Equal(t, db.docs["uid-web"]["metadata"].(map[string]interface{})["name"], "web")
+	assert.Equal(t, db.docs["uid-db"] != nil, true)
+	assert.Equal(t, db.docs["_design/views"] != nil, true)
+
+	// the agent carries on with the new ids
+	ka.IdScheme = IdSchemeUID
+	delta := testDelta(cache.Updated, "web", 3)
+	delta.Object.(*unstructured.Unstructured).SetUID(types.UID("uid-web"))
+	ka.applyBatch([]kubernetes.ResourceDelta{delta})
+	assert.Equal(t, db.writes["uid-web"], []string{"1", "3"})
+}
+
+func TestMigrateIds_Pages(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+
+	names := []string{"a", "b", "c", "d", "e"}
+	for i, name := range names {
+		delta := testDelta(cache.Added, name, i+1)
+		delta.Object.(*unstructured.Unstructured).SetUID(types.UID("uid-" + name))
+		ka.applyBatch([]kubernetes.ResourceDelta{delta})
+	}
+
+	defer func(size int) { migratePageSize = size }(migratePageSize)
+	migratePageSize = 2
+
+	moved, err := migrateIds(db, IdSchemeUID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// documents at the end of a page are moved too
+	assert.Equal(t, moved, len(names))
+	for _, name := range names {
+		assert.Equal(t, db.docs["uid-"+name] != nil, true, name)
+		assert.Equal(t, db.docs["Pod/default/"+name] == nil, true, name)
+	}
+}
@@ -8,13 +8,20 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh/terminal"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 var rootCmd = &cobra.Command{
@@ -46,6 +53,8 @@ service in the "kubist" namespace of the current cluster.
 var overrides = &clientcmd.ConfigOverrides{}
 
 var DefaultCouchDbUrl = "http://localhost:5984"
+var DefaultShutdownTimeout = 25 * time.Second
+var DefaultHttpAddress = ":8080"
 var DefaultResources = []map[string]interface{}{
 	{"group": "", "version": "v1", "resource": "pods"},
 }
@@ -70,6 +79,165 @@ func init() {
 			"WARNING: This may break replication",
 	)
 
+	rootCmd.PersistentFlags().Int(
+		"batch-size",
+		DefaultBatchSize,
+		"Maximum number of documents written per CouchDB request [BATCH_SIZE]",
+	)
+
+	rootCmd.PersistentFlags().Duration(
+		"batch-interval",
+		DefaultBatchInterval,
+		"Maximum time to wait for a batch to fill before writing it [BATCH_INTERVAL]",
+	)
+
+	rootCmd.Flags().Duration(
+		"checkpoint-interval",
+		DefaultCheckpointInterval,
+		"How often to save the resourceVersion each watch can resume from [CHECKPOINT_INTERVAL]",
+	)
+
+	rootCmd.Flags().String(
+		"reconcile",
+		string(DefaultReconcileMode),
+		"After listing a resource, remove documents for objects that no longer exist: "+
+			"delete, dry-run or off [RECONCILE]",
+	)
+
+	rootCmd.PersistentFlags().String(
+		"patches",
+		string(DefaultPatchMode),
+		"Keep a JSON Patch from the previous version of each updated document: "+
+			"inline in kubist.lastPatch, document in the <database>/changes database, or off [PATCHES]",
+	)
+
+	rootCmd.PersistentFlags().Bool(
+		"soft-delete",
+		false,
+		"Keep a tombstone document with the final state of each deleted object [SOFT_DELETE]",
+	)
+
+	rootCmd.PersistentFlags().Duration(
+		"tombstone-ttl",
+		DefaultTombstoneTTL,
+		"With --soft-delete, how long to keep tombstones, or 0 to keep them forever [TOMBSTONE_TTL]",
+	)
+
+	rootCmd.PersistentFlags().Bool(
+		"history",
+		false,
+		"Also record every change in the <database>/history database, see the history command [HISTORY]",
+	)
+
+	rootCmd.PersistentFlags().Int(
+		"history-max-revisions",
+		DefaultHistoryMaxRevisions,
+		"With --history, how many revisions to keep of each object, or 0 for all of them [HISTORY_MAX_REVISIONS]",
+	)
+
+	rootCmd.PersistentFlags().Duration(
+		"history-max-age",
+		DefaultHistoryMaxAge,
+		"With --history, how long to keep revisions, or 0 to keep them forever [HISTORY_MAX_AGE]",
+	)
+
+	rootCmd.Flags().String(
+		"http-address",
+		DefaultHttpAddress,
+		"Address to serve /metrics, /healthz and /readyz on, or empty to disable [HTTP_ADDRESS]",
+	)
+
+	rootCmd.Flags().Duration(
+		"shutdown-timeout",
+		DefaultShutdownTimeout,
+		"How long to wait for queued deltas to be written after SIGINT or SIGTERM [SHUTDOWN_TIMEOUT]",
+	)
+
+	rootCmd.Flags().Bool(
+		"discover",
+		false,
+		"Reflect every resource the API server can list and watch, instead of the configured resources [DISCOVER]",
+	)
+
+	rootCmd.Flags().StringSlice(
+		"include",
+		nil,
+		"With --discover or --watch-crds, only reflect resources matching these patterns, like pods or *.apps [INCLUDE]",
+	)
+
+	rootCmd.Flags().StringSlice(
+		"exclude",
+		kubernetes.DefaultExcludes,
+		"With --discover or --watch-crds, don't reflect resources matching these patterns [EXCLUDE]",
+	)
+
+	rootCmd.PersistentFlags().StringSlice(
+		"prune",
+		DefaultPrune,
+		"Fields removed from every object before it's written [PRUNE]",
+	)
+
+	rootCmd.PersistentFlags().StringSlice(
+		"ignore-changes",
+		DefaultIgnoreChanges,
+		"Fields that aren't worth a new revision when nothing else changed [IGNORE_CHANGES]",
+	)
+
+	rootCmd.Flags().StringSlice(
+		"namespaces",
+		nil,
+		"Reflect resources in these namespaces, instead of all namespaces [NAMESPACES]",
+	)
+
+	rootCmd.Flags().String(
+		"namespace-selector",
+		"",
+		"Reflect resources in namespaces whose labels match this selector, like team=payments, "+
+			"for as long as they match [NAMESPACE_SELECTOR]",
+	)
+
+	rootCmd.Flags().Bool(
+		"watch-crds",
+		false,
+		"Start reflecting custom resources when their CRDs are established, and stop when they're deleted [WATCH_CRDS]",
+	)
+
+	rootCmd.Flags().Bool(
+		"cleanup-crds",
+		false,
+		"With --watch-crds, delete the documents for custom resources when their CRD is deleted [CLEANUP_CRDS]",
+	)
+
+	rootCmd.Flags().Bool(
+		"leader-elect",
+		false,
+		"Only reflect resources while holding a lock shared with other replicas [LEADER_ELECT]",
+	)
+
+	rootCmd.Flags().String(
+		"leader-elect-namespace",
+		DefaultLeaderElectionNamespace,
+		"Namespace of the leader election ConfigMap [LEADER_ELECT_NAMESPACE]",
+	)
+
+	rootCmd.Flags().String(
+		"leader-elect-lock",
+		DefaultLeaderElectionLock,
+		"Name of the leader election ConfigMap [LEADER_ELECT_LOCK]",
+	)
+
+	rootCmd.Flags().String(
+		"leader-elect-identity",
+		"",
+		"Identity of this replica in leader election, defaults to the hostname [LEADER_ELECT_IDENTITY]",
+	)
+
+	rootCmd.Flags().Duration(
+		"leader-elect-lease-duration",
+		DefaultLeaseDuration,
+		"How long other replicas wait before taking over from a leader that stopped renewing [LEADER_ELECT_LEASE_DURATION]",
+	)
+
 	rootCmd.Flags().StringP(
 		"kubeconfig",
 		"f",
@@ -77,6 +245,24 @@ func init() {
 		"Path to your Kubeconfig [KUBECONFIG]",
 	)
 
+	rootCmd.Flags().StringSlice(
+		"contexts",
+		nil,
+		"Reflect each of these contexts in your Kubeconfig as a separate cluster, named after the context [CONTEXTS]",
+	)
+
+	rootCmd.Flags().StringSlice(
+		"kubeconfigs",
+		nil,
+		"Reflect the current context of each of these Kubeconfigs as a separate cluster, named after the context [KUBECONFIGS]",
+	)
+
+	rootCmd.PersistentFlags().String(
+		"cluster-name",
+		"",
+		"Name of the cluster, which prefixes document ids so several clusters can share a database [CLUSTER_NAME]",
+	)
+
 	rootCmd.Flags().BoolP(
 		"in-cluster",
 		"C",
@@ -84,28 +270,42 @@ func init() {
 		"Look for in-cluster configuration. Does not load a kubeconfig",
 	)
 
-	rootCmd.Flags().StringP(
+	rootCmd.PersistentFlags().String(
+		"database",
+		DefaultDatabaseTemplate,
+		"Name of the CouchDB database, with placeholders {hostname}, {cluster}, {context}, "+
+			"and {namespace}, {group}, {version} or {resource} for a database per namespace or resource [DATABASE]",
+	)
+
+	rootCmd.PersistentFlags().String(
+		"id-scheme",
+		"kind",
+		"How document ids are made from objects: kind, group-kind, uid, or a template "+
+			"with {group}, {version}, {kind}, {namespace}, {name} and {uid} [ID_SCHEME]",
+	)
+
+	rootCmd.PersistentFlags().StringP(
 		"couchdb-url",
 		"u",
 		DefaultCouchDbUrl,
 		"Base URL for CouchDB [COUCHDB_URL]",
 	)
 
-	rootCmd.Flags().StringP(
+	rootCmd.PersistentFlags().StringP(
 		"couchdb-username",
 		"U",
 		"",
 		"Username for CouchDB authentication [COUCHDB_USERNAME]",
 	)
 
-	rootCmd.Flags().StringP(
+	rootCmd.PersistentFlags().StringP(
 		"couchdb-password",
 		"P",
 		"",
 		"Password for CouchDB authentication [COUCHDB_PASSWORD]",
 	)
 
-	rootCmd.Flags().BoolP(
+	rootCmd.PersistentFlags().BoolP(
 		"couchdb-read-password",
 		"p",
 		false,
@@ -131,49 +331,293 @@ func loadConfig() {
 		panic("binding flags: " + err.Error())
 	}
 
+	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
+		panic("binding flags: " + err.Error())
+	}
+
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 }
 
 func execute(cmd *cobra.Command, _ []string) {
-	err := viper.ReadInConfig()
-	if err == nil {
-		fmt.Println("[~] Read config from " + viper.ConfigFileUsed())
-	} else if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound {
-		panic("reading config: " + err.Error())
-	}
+	readConfig()
 
-	pool := createKubernetesClient(cmd)
+	clusters := createClusters(cmd)
 	cc := createCouchDbClient(cmd)
+	cc.Observer = observeCouchDbRequest
+
+	var resources []schema.GroupVersionResource
+	selectors := make(map[schema.GroupVersionResource]kubernetes.Selectors)
+	redactions := make(map[schema.GroupVersionResource][]Redaction)
+	noDefaultRedactions := make(map[schema.GroupVersionResource]bool)
+	var transformers []Transformer
+	for _, c := range configuredResources() {
+		resources = append(resources, c.Resource)
+		if c.Selectors != (kubernetes.Selectors{}) {
+			selectors[c.Resource] = c.Selectors
+		}
+		if c.Redactions != nil {
+			redactions[c.Resource] = c.Redactions
+		}
+		if c.NoDefaultRedactions {
+			noDefaultRedactions[c.Resource] = true
+		}
+		if len(c.Transforms) > 0 {
+			transformers = append(transformers, ForResource(c.Resource, c.Transforms...))
+		}
+	}
 
-	host, err := os.Hostname()
+	namespaces := getStringSlice("namespaces")
+	if ns := viper.GetString("kube-namespace"); ns != "" {
+		namespaces = append(namespaces, ns)
+	}
+	selector := namespaceSelector()
+
+	reconcile, err := ParseReconcileMode(viper.GetString("reconcile"))
 	if err != nil {
 		panic(err.Error())
 	}
 
-	name := strings.Replace("kubist/"+host, ".", "_", -1)
-	name = strings.ToLower(name)
+	patches := patchMode()
+	template := databaseTemplate()
+	if viper.GetBool("in-cluster") && strings.Contains(string(template), "{hostname}") {
+		fmt.Println("[!] The database is named after the hostname, which changes " +
+			"when the pod is rescheduled. Set --database to keep using the same one")
+	}
 
-	db := cc.Database(name)
+	// one agent for each cluster, sharing home databases when the template
+	// gives them the same name
+	homes := make(map[string]*homeDatabases)
+	agents := make([]*KubistAgent, len(clusters))
+	for i, c := range clusters {
+		values := c.databaseValues(hostname())
+		name := template.Home(values)
+		home := homes[name]
+		if home == nil {
+			home = openHomeDatabases(cc, name, patches, viper.GetBool("recreate-database"))
+			home.reportDeadLetters()
+			homes[name] = home
+		}
 
-	var exists bool
-	recreateDatabase := viper.GetBool("recreate-database")
-	if exists, err = db.Exists(); err != nil {
-		panic(err.Error())
-	} else if exists && recreateDatabase {
-		fmt.Println("[+] Dropping database " + name)
-		if err = db.Drop(); err != nil {
-			panic(err.Error())
+		pool := createKubernetesClient(c.Config)
+		disco := createDiscoveryClient(c.Config)
+
+		clusterResources := resources
+		if viper.GetBool("discover") {
+			clusterResources = discoverResources(disco)
 		}
+
+		fmt.Printf("[+] Reflecting %+v in %s%s to database %#v\n",
+			clusterResources, describeNamespaces(namespaces, selector), describeCluster(c.Name),
+			template.Name(values))
+
+		agent := newAgent(cc, home, template, values, pool, clusterResources, namespaces)
+		agent.Cluster = c.Name
+		agent.NamespaceSelector = selector
+		agent.Selectors = selectors
+		agent.Redactions = redactions
+		agent.NoDefaultRedactions = noDefaultRedactions
+		agent.Transformers = transformers
+		agent.Discovery = disco
+		agent.LeaderElect = viper.GetBool("leader-elect")
+		agent.Checkpoints = NewCheckpointStore(home.db, c.Name)
+		agent.CheckpointInterval = viper.GetDuration("checkpoint-interval")
+		agent.Reconcile = reconcile
+
+		agent.WatchCRDs = viper.GetBool("watch-crds")
+		agent.CRDFilter = resourceFilter()
+		agent.CleanupCRDs = viper.GetBool("cleanup-crds")
+
+		agents[i] = agent
 	}
 
-	if !exists || recreateDatabase {
-		fmt.Println("[+] Creating database " + name)
-		if err = db.Create(); err != nil {
-			panic(err.Error())
+	if addr := viper.GetString("http-address"); addr != "" {
+		serveHTTP(addr, agents, cc)
+	}
+
+	go sweepEvery(agents, DefaultSweepInterval)
+
+	// each cluster elects its own leader, with a lock in that cluster
+	dones := make([]chan struct{}, len(agents))
+	var elections []*leaderElection
+	for i, agent := range agents {
+		dones[i] = make(chan struct{})
+		if viper.GetBool("leader-elect") {
+			election := createLeaderElection(clusters[i].Config, agent, dones[i])
+			election.Run()
+			elections = append(elections, election)
+		} else {
+			go func(agent *KubistAgent, done chan struct{}) {
+				agent.Run()
+				close(done)
+			}(agent, dones[i])
+		}
+	}
+
+	status := waitForShutdown(agents, dones, viper.GetDuration("shutdown-timeout"))
+	for _, election := range elections {
+		if election.Lost() {
+			status = 1
+		} else {
+			election.Release()
+		}
+	}
+
+	os.Exit(status)
+}
+
+// Wait for SIGINT or SIGTERM, then stop the agents and give them timeout to
+// apply the deltas they already received. If one agent stops by itself,
+// after losing leadership, the rest are stopped too. Returns the exit
+// status, which is non-zero if the agents didn't finish in time.
+func waitForShutdown(agents []*KubistAgent, dones []chan struct{}, timeout time.Duration) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	stopped := make(chan struct{})
+	var once sync.Once
+	for _, agent := range agents {
+		go func(agent *KubistAgent) {
+			<-agent.stop
+			once.Do(func() { close(stopped) })
+		}(agent)
+	}
+
+	select {
+	case sig := <-signals:
+		fmt.Printf("[+] Received %s, shutting down\n", sig)
+	case <-stopped:
+		// stopped after losing leadership
+	}
+
+	for _, agent := range agents {
+		agent.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, d := range dones {
+			<-d
 		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("[+] Shut down cleanly")
+		return 0
+	case sig := <-signals:
+		fmt.Printf("[!] Received %s again, exiting without draining\n", sig)
+	case <-time.After(timeout):
+		fmt.Printf("[!] Timed out after %s, exiting without draining\n", timeout)
 	}
 
+	// keep whatever was applied before giving up
+	for _, agent := range agents {
+		if agent.Checkpoints != nil {
+			agent.saveCheckpoint()
+		}
+	}
+	return 1
+}
+
+// The database for the agents' own documents, and its companions.
+type homeDatabases struct {
+	name         string
+	db           couchdb.DatabaseInterface
+	deadLetters  *DeadLetterStore
+	changeEvents couchdb.DatabaseInterface // with PatchDocument
+	history      *HistoryStore             // with --history
+}
+
+// Open the home database called name and its companions, creating any that
+// don't exist, and dropping the home database first if recreate is set.
+func openHomeDatabases(cc *couchdb.Client, name string, patches PatchMode, recreate bool) *homeDatabases {
+	home := &homeDatabases{name: name, db: cc.Database(name)}
+	ensureDatabase(home.db, name, recreate)
+
+	deadLetterName := deadLetterDatabaseName(name)
+	deadLetterDb := cc.Database(deadLetterName)
+	ensureDatabase(deadLetterDb, deadLetterName, false)
+	home.deadLetters = NewDeadLetterStore(deadLetterDb)
+
+	if patches == PatchDocument {
+		changesName := changesDatabaseName(name)
+		home.changeEvents = cc.Database(changesName)
+		ensureDatabase(home.changeEvents, changesName, false)
+	}
+
+	if viper.GetBool("history") {
+		historyName := historyDatabaseName(name)
+		historyDb := cc.Database(historyName)
+		ensureDatabase(historyDb, historyName, false)
+
+		home.history = NewHistoryStore(historyDb)
+		home.history.MaxRevisions = viper.GetInt("history-max-revisions")
+		home.history.MaxAge = viper.GetDuration("history-max-age")
+		home.history.BatchSize, _ = batchConfig()
+	}
+
+	return home
+}
+
+// Print how many dead letters are waiting to be replayed, if any.
+func (home *homeDatabases) reportDeadLetters() {
+	res, err := home.deadLetters.db.AllDocs(couchdb.AllDocsOptions{Limit: 1})
+	if err != nil {
+		panic(err.Error())
+	} else if res.TotalRows > 0 {
+		fmt.Printf("[!] %d dead letters in %s, see `kubist-agent dead-letters`\n",
+			res.TotalRows, deadLetterDatabaseName(home.name))
+	}
+}
+
+// Returns an agent that writes to the home databases, and to the others
+// named by template for values, configured from flags and config. Its
+// resources are watched with pool; without one, it can only apply deltas
+// it's given.
+func newAgent(
+	cc *couchdb.Client,
+	home *homeDatabases,
+	template DatabaseTemplate,
+	values databaseValues,
+	pool dynamic.ClientPool,
+	resources []schema.GroupVersionResource,
+	namespaces []string,
+) *KubistAgent {
+	agent := NewKubistAgent(home.db, pool, resources, namespaces)
+	if template.PerObject() {
+		agent.Databases = NewDatabaseRouter(cc, template, values)
+	}
+	agent.IdScheme = idScheme()
+	agent.Prune = fieldPaths("prune")
+	agent.IgnoreChanges = fieldPaths("ignore-changes")
+	agent.BatchSize, agent.BatchInterval = batchConfig()
+	agent.DeadLetters = home.deadLetters
+	agent.Patches = patchMode()
+	agent.ChangeEvents = home.changeEvents
+	agent.History = home.history
+
+	agent.SoftDelete = viper.GetBool("soft-delete")
+	agent.TombstoneTTL = viper.GetDuration("tombstone-ttl")
+
+	return agent
+}
+
+// An entry in the "resources" config. Its selectors and redactions also
+// apply when the resource is discovered.
+type resourceConfig struct {
+	Resource   schema.GroupVersionResource
+	Selectors  kubernetes.Selectors
+	Redactions []Redaction // applied after the defaults
+	Transforms []Transformer
+
+	NoDefaultRedactions bool
+}
+
+// Returns the resources listed in the "resources" config.
+func configuredResources() []resourceConfig {
 	// parse unknown json objects as a slice of maps
 	var rawResources []map[string]interface{}
 	switch o := viper.Get("resources").(type) {
@@ -192,33 +636,225 @@ func execute(cmd *cobra.Command, _ []string) {
 		panic(fmt.Sprintf("resources: can't parse from %T\n", o))
 	}
 
-	resources := make([]schema.GroupVersionResource, 0, 10)
-	for _, r := range rawResources {
+	resources := make([]resourceConfig, 0, 10)
+	for i, r := range rawResources {
 		// group can be nil for core resources
 		var group string
 		if g, exists := r["group"]; exists {
 			group = g.(string)
 		}
 
-		gvr := schema.GroupVersionResource{
-			Group:    group,
-			Version:  r["version"].(string),
-			Resource: r["resource"].(string),
+		c := resourceConfig{
+			Resource: schema.GroupVersionResource{
+				Group:    group,
+				Version:  r["version"].(string),
+				Resource: r["resource"].(string),
+			},
+		}
+
+		c.Selectors.Label, _ = r["labelSelector"].(string)
+		if _, err := labels.Parse(c.Selectors.Label); err != nil {
+			panic(fmt.Sprintf("resources[%d].labelSelector: %s\n", i, err.Error()))
+		}
+
+		c.Selectors.Field, _ = r["fieldSelector"].(string)
+		if _, err := fields.ParseSelector(c.Selectors.Field); err != nil {
+			panic(fmt.Sprintf("resources[%d].fieldSelector: %s\n", i, err.Error()))
+		}
+
+		if raw, exists := r["redact"]; exists {
+			redactions, err := parseRedactions(raw)
+			if err != nil {
+				panic(fmt.Sprintf("resources[%d].redact: %s\n", i, err.Error()))
+			}
+			c.Redactions = redactions
 		}
-		resources = append(resources, gvr)
+
+		if raw, exists := r["defaultRedactions"]; exists {
+			keep, ok := raw.(bool)
+			if !ok {
+				panic(fmt.Sprintf("resources[%d].defaultRedactions: not a boolean\n", i))
+			}
+			c.NoDefaultRedactions = !keep
+		}
+
+		if raw, exists := r["transforms"]; exists {
+			transforms, err := parseTransforms(raw)
+			if err != nil {
+				panic(fmt.Sprintf("resources[%d].transforms: %s\n", i, err.Error()))
+			}
+			c.Transforms = transforms
+		}
+
+		resources = append(resources, c)
 	}
 
-	namespace := viper.GetString("kube-namespace")
+	return resources
+}
 
-	nsDesc := "namespace " + namespace
-	if namespace == "" {
-		nsDesc = "all namespaces"
+// Returns every watchable resource on the API server that matches the
+// include and exclude patterns.
+func discoverResources(d discovery.DiscoveryInterface) []schema.GroupVersionResource {
+	resources, err := kubernetes.DiscoverResources(d, resourceFilter())
+	if err != nil {
+		panic("discovering resources: " + err.Error())
 	}
-	fmt.Printf("[+] Reflecting %+v in %s to database %#v\n",
-		resources, nsDesc, name)
 
-	agent := NewKubistAgent(db, pool, resources, namespace)
-	agent.Run()
+	return resources
+}
+
+// Returns the parsed namespace selector, or nil if there isn't one.
+func namespaceSelector() labels.Selector {
+	s := viper.GetString("namespace-selector")
+	if s == "" {
+		return nil
+	}
+
+	selector, err := labels.Parse(s)
+	if err != nil {
+		panic("namespace selector: " + err.Error())
+	}
+	return selector
+}
+
+func describeNamespaces(namespaces []string, selector labels.Selector) string {
+	var desc []string
+	if len(namespaces) > 0 {
+		desc = append(desc, "namespaces "+strings.Join(namespaces, ", "))
+	}
+	if selector != nil {
+		desc = append(desc, "namespaces matching "+selector.String())
+	}
+
+	if len(desc) == 0 {
+		return "all namespaces"
+	}
+	return strings.Join(desc, " and ")
+}
+
+// Describes the cluster named name for logs, if it has a name.
+func describeCluster(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " of cluster " + name
+}
+
+// Returns the field paths in a list from flags or config.
+func fieldPaths(key string) []FieldPath {
+	fps, err := parseFieldPaths(getStringSlice(key))
+	if err != nil {
+		panic(key + ": " + err.Error())
+	}
+	return fps
+}
+
+func resourceFilter() kubernetes.ResourceFilter {
+	return kubernetes.ResourceFilter{
+		Include: getStringSlice("include"),
+		Exclude: getStringSlice("exclude"),
+	}
+}
+
+// Returns a list from a flag, config array or environment variable. Items
+// can be separated by commas, or spaces in environment variables.
+func getStringSlice(key string) []string {
+	var list []string
+	for _, item := range viper.GetStringSlice(key) {
+		for _, s := range strings.Split(item, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+func readConfig() {
+	err := viper.ReadInConfig()
+	if err == nil {
+		fmt.Println("[~] Read config from " + viper.ConfigFileUsed())
+	} else if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound {
+		panic("reading config: " + err.Error())
+	}
+}
+
+// Returns the name of the home database for commands that don't connect to
+// Kubernetes, which name the cluster with --cluster-name.
+func databaseName() string {
+	return databaseTemplate().Home(commandDatabaseValues())
+}
+
+func commandDatabaseValues() databaseValues {
+	c := cluster{Name: viper.GetString("cluster-name"), Context: overrides.CurrentContext}
+	return c.databaseValues(hostname())
+}
+
+func databaseTemplate() DatabaseTemplate {
+	t, err := ParseDatabaseTemplate(viper.GetString("database"))
+	if err != nil {
+		panic(err.Error())
+	}
+	return t
+}
+
+// Returns the batch size and interval, which must be positive.
+func batchConfig() (int, time.Duration) {
+	size := viper.GetInt("batch-size")
+	if size < 1 {
+		panic(fmt.Sprintf("batch-size must be at least 1, got %d", size))
+	}
+
+	interval := viper.GetDuration("batch-interval")
+	if interval <= 0 {
+		panic(fmt.Sprintf("batch-interval must be positive, got %s", interval))
+	}
+
+	return size, interval
+}
+
+func patchMode() PatchMode {
+	m, err := ParsePatchMode(viper.GetString("patches"))
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+func idScheme() IdScheme {
+	s, err := ParseIdScheme(viper.GetString("id-scheme"))
+	if err != nil {
+		panic(err.Error())
+	}
+	return s
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		panic(err.Error())
+	}
+	return host
+}
+
+// Create the database if it doesn't exist, optionally dropping it first.
+func ensureDatabase(db couchdb.DatabaseInterface, name string, recreate bool) {
+	exists, err := db.Exists()
+	if err != nil {
+		panic(err.Error())
+	} else if exists && recreate {
+		fmt.Println("[+] Dropping database " + name)
+		if err = db.Drop(); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if !exists || recreate {
+		fmt.Println("[+] Creating database " + name)
+		if err = db.Create(); err != nil {
+			panic(err.Error())
+		}
+	}
 }
 
 func createCouchDbClient(_ *cobra.Command) *couchdb.Client {
@@ -234,7 +870,7 @@ func createCouchDbClient(_ *cobra.Command) *couchdb.Client {
 		}
 	}
 
-	auth := &couchdb.Auth{username, password}
+	auth := &couchdb.Auth{Username: username, Password: password}
 	cc, err := couchdb.NewClient(url, auth)
 	if err != nil {
 		panic(err.Error())
@@ -243,31 +879,68 @@ func createCouchDbClient(_ *cobra.Command) *couchdb.Client {
 	return cc
 }
 
-func createKubernetesClient(_ *cobra.Command) dynamic.ClientPool {
-	var (
-		err        error
-		kubeConfig *rest.Config
-	)
-
+func createKubernetesConfig(_ *cobra.Command) *rest.Config {
 	if viper.GetBool("in-cluster") {
-		kubeConfig, err = rest.InClusterConfig()
+		kubeConfig, err := rest.InClusterConfig()
 		if err != nil {
 			panic("in-cluster config failed: " + err.Error())
 		}
-	} else {
-		path := viper.GetString("kubeconfig")
-		kubeConfig, err = kubernetes.NewClientConfig(path, overrides)
-		if err != nil {
-			panic(fmt.Sprintf("kubeconfig %#v failed: %s",
-				path, err.Error()))
-		}
+		return kubeConfig
+	}
+
+	path := viper.GetString("kubeconfig")
+	kubeConfig, err := kubernetes.NewClientConfig(path, overrides)
+	if err != nil {
+		panic(fmt.Sprintf("kubeconfig %#v failed: %s",
+			path, err.Error()))
 	}
+	return kubeConfig
+}
 
-	pool := dynamic.NewDynamicClientPool(kubeConfig)
+func createKubernetesClient(config *rest.Config) dynamic.ClientPool {
+	pool := dynamic.NewDynamicClientPool(config)
 
 	return pool
 }
 
+func createDiscoveryClient(config *rest.Config) discovery.DiscoveryInterface {
+	d, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return d
+}
+
+func createLeaderElection(config *rest.Config, agent *KubistAgent, done chan struct{}) *leaderElection {
+	client, err := clientset.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	identity := viper.GetString("leader-elect-identity")
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	l, err := newLeaderElection(
+		agent,
+		client,
+		viper.GetString("leader-elect-namespace"),
+		viper.GetString("leader-elect-lock"),
+		identity,
+		viper.GetDuration("leader-elect-lease-duration"),
+		done,
+	)
+	if err != nil {
+		panic("leader election: " + err.Error())
+	}
+
+	return l
+}
+
 func promptForPassword(prompt string) (string, error) {
 	stdin := syscall.Stdin
 	if terminal.IsTerminal(stdin) {
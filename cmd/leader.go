@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"sync"
+	"time"
+)
+
+var DefaultLeaseDuration = 15 * time.Second
+var DefaultLeaderElectionLock = "kubist-agent"
+var DefaultLeaderElectionNamespace = "default"
+
+// A leaderElection runs an agent only while this replica holds a lock on a
+// ConfigMap, so replicas don't write the same documents.
+type leaderElection struct {
+	agent *KubistAgent
+	lock  resourcelock.Interface
+	le    *leaderelection.LeaderElector
+	done  chan struct{}
+
+	mu      sync.Mutex
+	leading bool
+	stopped bool // shut down before leading
+	lost    bool // stopped leading while running
+}
+
+func newLeaderElection(
+	agent *KubistAgent,
+	client clientset.Interface,
+	namespace, name, identity string,
+	leaseDuration time.Duration,
+	done chan struct{},
+) (*leaderElection, error) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(namespace),
+	})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "kubist-agent"})
+
+	lock, err := resourcelock.New(
+		resourcelock.ConfigMapsResourceLock,
+		namespace,
+		name,
+		client.CoreV1(),
+		resourcelock.ResourceLockConfig{Identity: identity, EventRecorder: recorder},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &leaderElection{agent: agent, lock: lock, done: done}
+
+	// the same ratios as kube-controller-manager's 15s, 10s and 2s
+	renewDeadline := leaseDuration * 2 / 3
+	l.le, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   renewDeadline / 5,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: l.startedLeading,
+			OnStoppedLeading: l.stoppedLeading,
+			OnNewLeader: func(identity string) {
+				fmt.Printf("[~] Leader is %s\n", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Campaign for the lock in the background. done is closed once the agent
+// has run and stopped, or when the agent is stopped before it could run.
+func (l *leaderElection) Run() {
+	fmt.Printf("[+] Waiting to lead %s\n", l.lock.Describe())
+	go l.le.Run()
+
+	go func() {
+		<-l.agent.stop
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !l.leading {
+			l.stopped = true
+			close(l.done)
+		}
+	}()
+}
+
+func (l *leaderElection) startedLeading(_ <-chan struct{}) {
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return
+	}
+	l.leading = true
+	l.mu.Unlock()
+
+	fmt.Printf("[+] Leading %s\n", l.lock.Describe())
+	l.agent.Run()
+	close(l.done)
+}
+
+func (l *leaderElection) stoppedLeading() {
+	l.mu.Lock()
+	leading := l.leading
+	l.lost = leading
+	l.mu.Unlock()
+
+	if leading {
+		fmt.Printf("[!] Lost leadership of %s, stopping\n", l.lock.Describe())
+		l.agent.Stop()
+	}
+}
+
+// Returns true if the lock was lost while the agent was running.
+func (l *leaderElection) Lost() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Clear the lock's holder, if this replica still holds it, so it no longer
+// names a replica that has shut down. Other replicas still wait for the
+// lease to expire before taking over, since they only see that the record
+// changed.
+func (l *leaderElection) Release() {
+	record, err := l.lock.Get()
+	if err != nil || record.HolderIdentity != l.lock.Identity() {
+		return
+	}
+
+	record.HolderIdentity = ""
+	record.RenewTime = metav1.Now()
+	if err := l.lock.Update(*record); err != nil {
+		fmt.Printf("[!] Releasing %s: %s\n", l.lock.Describe(), err.Error())
+	} else {
+		fmt.Printf("[+] Released %s\n", l.lock.Describe())
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+var (
+	deltasReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubist_deltas_received_total",
+			Help: "Deltas received from Kubernetes, by cluster, resource and delta type.",
+		},
+		[]string{"cluster", "group", "version", "resource", "type"},
+	)
+
+	conflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubist_resource_version_conflicts_total",
+			Help: "Deltas skipped because the document has a newer resourceVersion, by cluster, kind and delta type.",
+		},
+		[]string{"cluster", "kind", "type"},
+	)
+
+	watchRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubist_watch_restarts_total",
+			Help: "Watches restarted after they closed or failed, by cluster, resource and namespace.",
+		},
+		[]string{"cluster", "group", "version", "resource", "namespace"},
+	)
+
+	deadLetters = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubist_dead_letters_total",
+			Help: "Deltas recorded as dead letters, by reason: invalid, rejected or retries_exhausted.",
+		},
+		[]string{"reason"},
+	)
+
+	couchDbRequests = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kubist_couchdb_request_duration_seconds",
+			Help:    "CouchDB request latency, by method and status code. The code is 0 if no response was received.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deltasReceived, conflicts, watchRestarts, deadLetters, couchDbRequests)
+}
+
+// Returns a gauge of the deltas the agents have received but not yet applied.
+func queueDepthGauge(agents []*KubistAgent) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "kubist_queue_depth",
+			Help: "Deltas received from Kubernetes that haven't been written to CouchDB yet.",
+		},
+		func() float64 {
+			depth := 0
+			for _, ka := range agents {
+				depth += ka.tracker.depth()
+			}
+			return float64(depth)
+		},
+	)
+}
+
+func observeCouchDbRequest(method string, code int, elapsed time.Duration) {
+	couchDbRequests.WithLabelValues(method, strconv.Itoa(code)).Observe(elapsed.Seconds())
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strings"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Args:  cobra.NoArgs,
+	Short: "Rewrite existing documents to the ids of --id-scheme",
+	Long: `Rewrite existing documents to the ids of --id-scheme.
+
+Every document for an object whose id doesn't follow --id-scheme is copied
+to the id it gives, then removed. Stop the agent first, and start it again
+with the same --id-scheme once the migration is done; otherwise it keeps
+writing documents under the old ids. The history and changes databases
+keep their old ids.
+`,
+	Example: `  kubist-agent migrate --id-scheme uid --dry-run`,
+	Run:     executeMigrate,
+}
+
+func init() {
+	migrateCmd.Flags().Bool(
+		"dry-run",
+		false,
+		"Only print the documents that would be moved",
+	)
+
+	rootCmd.AddCommand(migrateCmd)
+}
+
+// Number of documents migrateIds reads at a time.
+var migratePageSize = 500
+
+// Move every document for an object in db whose id doesn't follow scheme to
+// the id it gives, or with dryRun, only report it. Returns the number of
+// documents moved.
+func migrateIds(db couchdb.DatabaseInterface, scheme IdScheme, dryRun bool) (int, error) {
+	moved := 0
+
+	// each page starts from the last id read, rather than skipping it,
+	// since it may have been moved away
+	last := ""
+	for {
+		res, err := db.AllDocs(couchdb.AllDocsOptions{StartKey: last, IncludeDocs: true, Limit: migratePageSize})
+		if err != nil {
+			return moved, err
+		}
+
+		var puts, olds []couchdb.Body
+		for _, row := range res.Rows {
+			if last != "" && row.Id == last {
+				continue // read with the previous page
+			} else if row.Doc == nil || strings.HasPrefix(row.Id, "_design/") {
+				continue
+			}
+
+			obj := &unstructured.Unstructured{Object: row.Doc}
+			if obj.GetKind() == "" || obj.GetName() == "" {
+				continue // not an object
+			}
+
+			id, err := scheme.DocumentId(obj)
+			if err != nil {
+				fmt.Printf("[!] MIGRATE %s: %s\n", row.Id, err.Error())
+				continue
+			} else if id == row.Id {
+				continue
+			}
+
+			fmt.Printf("[~] MIGRATE %s to %s\n", row.Id, id)
+			if dryRun {
+				moved++
+				continue
+			}
+
+			put := make(couchdb.Body, len(row.Doc))
+			for k, v := range row.Doc {
+				put[k] = v
+			}
+			put["_id"] = id
+			delete(put, "_rev")
+
+			puts = append(puts, put)
+			olds = append(olds, couchdb.Body{"_id": row.Id, "_rev": row.Doc["_rev"], "_deleted": true})
+		}
+
+		if len(puts) > 0 {
+			results, err := db.BulkDocs(puts)
+			if err != nil {
+				return moved, err
+			}
+
+			// the old document is only removed once its copy is written
+			var deletes []couchdb.Body
+			for i, result := range results {
+				if result.Error != "" {
+					fmt.Printf("[!] MIGRATE %s: %s: %s\n", olds[i]["_id"], result.Error, result.Reason)
+				} else {
+					deletes = append(deletes, olds[i])
+				}
+			}
+
+			if len(deletes) > 0 {
+				results, err = db.BulkDocs(deletes)
+				if err != nil {
+					return moved, err
+				}
+				for i, result := range results {
+					if result.Error != "" {
+						fmt.Printf("[!] MIGRATE %s: %s: %s\n", deletes[i]["_id"], result.Error, result.Reason)
+					} else {
+						moved++
+					}
+				}
+			}
+		}
+
+		if len(res.Rows) < migratePageSize {
+			return moved, nil
+		}
+		last = res.Rows[len(res.Rows)-1].Id
+	}
+}
+
+func executeMigrate(cmd *cobra.Command, _ []string) {
+	readConfig()
+
+	cc := createCouchDbClient(cmd)
+	scheme := idScheme()
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	template := databaseTemplate()
+	dbs := []couchdb.DatabaseInterface{cc.Database(databaseName())}
+	if template.PerObject() {
+		var err error
+		router := NewDatabaseRouter(cc, template, commandDatabaseValues())
+		if dbs, err = router.Existing(schema.GroupVersionResource{}, ""); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	total := 0
+	for _, db := range dbs {
+		moved, err := migrateIds(db, scheme, dryRun)
+		total += moved
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("[~] %d documents would be moved (dry run)\n", total)
+	} else {
+		fmt.Printf("[+] Moved %d documents to %s ids\n", total, scheme)
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+var namespaceResource = schema.GroupVersionResource{
+	Version:  "v1",
+	Resource: "namespaces",
+}
+
+// Watch namespaces, starting watchers in each one that matches
+// NamespaceSelector, and stopping them once it's deleted or stops matching.
+func (ka *KubistAgent) watchNamespaces() error {
+	client, err := ka.pool.ClientForGroupVersionResource(namespaceResource)
+	if err != nil {
+		return err
+	}
+
+	rw := kubernetes.NewResourceWatcher(client, namespaceResource, false, "")
+
+	ka.mu.Lock()
+	select {
+	case <-ka.stop:
+		ka.mu.Unlock()
+		return nil
+	default:
+		ka.nsWatcher = rw
+	}
+	ka.mu.Unlock()
+
+	ch := rw.Watch()
+	go func() {
+		for delta := range ch {
+			ka.handleNamespace(delta.Delta)
+		}
+	}()
+
+	return nil
+}
+
+func (ka *KubistAgent) handleNamespace(delta cache.Delta) {
+	name := ""
+	matches := false
+	switch obj := delta.Object.(type) {
+	case cache.DeletedFinalStateUnknown:
+		name = obj.Key
+	case *unstructured.Unstructured:
+		name = obj.GetName()
+		matches = delta.Type != cache.Deleted &&
+			ka.NamespaceSelector.Matches(labels.Set(obj.GetLabels()))
+	default:
+		return
+	}
+
+	// listed namespaces are watched whether they exist or not
+	for _, ns := range ka.Namespaces {
+		if ns == name {
+			return
+		}
+	}
+
+	if matches {
+		ka.addNamespace(name)
+	} else {
+		ka.removeNamespace(name)
+	}
+}
+
+// Start watching every resource in namespace.
+func (ka *KubistAgent) addNamespace(namespace string) {
+	ka.mu.Lock()
+	if ka.namespaces[namespace] {
+		ka.mu.Unlock()
+		return
+	}
+
+	ka.namespaces[namespace] = true
+	resources := append([]schema.GroupVersionResource{}, ka.Resources...)
+	for _, cr := range ka.crds {
+		resources = append(resources, cr.Resource)
+	}
+	ka.mu.Unlock()
+
+	fmt.Printf("[+] Watching namespace %s\n", namespace)
+	for _, gvr := range resources {
+		if err := ka.startWatcher(gvr, namespace); err != nil {
+			fmt.Printf("[!] Namespace %s: %s\n", namespace, err.Error())
+		}
+	}
+}
+
+// Stop every watcher in namespace. Documents for its objects are kept.
+func (ka *KubistAgent) removeNamespace(namespace string) {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if !ka.namespaces[namespace] {
+		return
+	}
+
+	delete(ka.namespaces, namespace)
+	for key, rw := range ka.watchers {
+		if key.Namespace == namespace {
+			rw.Stop()
+			delete(ka.watchers, key)
+		}
+	}
+
+	fmt.Printf("[+] No longer watching namespace %s\n", namespace)
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestKubistAgent_handleNamespace(t *testing.T) {
+	ka := newTestAgent(newFakeDatabase())
+	ka.Namespaces = []string{"listed"}
+	ka.NamespaceSelector = labels.SelectorFromSet(labels.Set{"team": "payments"})
+	ka.namespaces["listed"] = true
+
+	namespace := func(name string, set map[string]string) *unstructured.Unstructured {
+		ns := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		ns.SetName(name)
+		ns.SetLabels(set)
+		return ns
+	}
+
+	payments := map[string]string{"team": "payments"}
+	ka.handleNamespace(cache.Delta{Type: cache.Sync, Object: namespace("billing", payments)})
+	ka.handleNamespace(cache.Delta{Type: cache.Sync, Object: namespace("other", nil)})
+	ka.handleNamespace(cache.Delta{Type: cache.Sync, Object: namespace("listed", nil)})
+	assert.Equal(t, ka.watchedNamespaces(), []string{"billing", "listed"})
+
+	// relabeled out of the selector
+	ka.handleNamespace(cache.Delta{Type: cache.Updated, Object: namespace("billing", nil)})
+	assert.Equal(t, ka.watchedNamespaces(), []string{"listed"})
+
+	ka.handleNamespace(cache.Delta{Type: cache.Added, Object: namespace("ledger", payments)})
+	ka.handleNamespace(cache.Delta{Type: cache.Deleted, Object: cache.DeletedFinalStateUnknown{Key: "ledger"}})
+	ka.handleNamespace(cache.Delta{Type: cache.Deleted, Object: namespace("listed", nil)})
+	assert.Equal(t, ka.watchedNamespaces(), []string{"listed"})
+}
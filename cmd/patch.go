@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where the agent keeps the JSON Patch from the previous version of a
+// document to the next, for each update it writes.
+type PatchMode string
+
+const (
+	PatchOff PatchMode = "off"
+	// In the document itself, under kubist.lastPatch.
+	PatchInline PatchMode = "inline"
+	// In a change event document in the <database>/changes database.
+	PatchDocument PatchMode = "document"
+)
+
+var DefaultPatchMode = PatchOff
+
+var lastPatchFields = []string{"kubist", "lastPatch"}
+
+func ParsePatchMode(s string) (PatchMode, error) {
+	switch m := PatchMode(s); m {
+	case PatchOff, PatchInline, PatchDocument:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown patch mode %#v", s)
+	}
+}
+
+// Returns the name of the database for change events for the database name.
+func changesDatabaseName(name string) string {
+	return name + "/changes"
+}
+
+// Returns an RFC 6902 JSON Patch that turns the document from into to. It
+// starts by testing the resourceVersion of from, so it can't be applied to
+// any other version. Both are left unchanged.
+func jsonPatch(from, to map[string]interface{}) ([]interface{}, error) {
+	a, err := patchable(from)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := patchable(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv interface{}
+	if metadata, ok := a["metadata"].(map[string]interface{}); ok {
+		rv = metadata["resourceVersion"]
+	}
+
+	ops := []interface{}{patchOp("test", "/metadata/resourceVersion", rv)}
+	return diff(ops, "", a, b), nil
+}
+
+// Returns a copy of obj as it decodes from JSON, without the fields that
+// aren't part of the object.
+func patchable(obj map[string]interface{}) (map[string]interface{}, error) {
+	c, err := jsonCopy(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(c, "_id")
+	delete(c, "_rev")
+	if kubist, ok := c["kubist"].(map[string]interface{}); ok {
+		delete(kubist, "lastPatch")
+		if len(kubist) == 0 {
+			delete(c, "kubist")
+		}
+	}
+
+	return c, nil
+}
+
+// Returns a copy of obj that can be changed without touching it, with
+// numbers as they come from CouchDB.
+func jsonCopy(obj map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var c map[string]interface{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Append the operations that turn a into b, both at path, to ops. Lists of
+// the same length are patched item by item, and otherwise replaced.
+func diff(ops []interface{}, path string, a, b interface{}) []interface{} {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		for _, k := range sortedKeys(a) {
+			p := path + "/" + escapePointer(k)
+			if bv, exists := b[k]; exists {
+				ops = diff(ops, p, a[k], bv)
+			} else {
+				ops = append(ops, patchOp("remove", p, nil))
+			}
+		}
+		for _, k := range sortedKeys(b) {
+			if _, exists := a[k]; !exists {
+				ops = append(ops, patchOp("add", path+"/"+escapePointer(k), b[k]))
+			}
+		}
+		return ops
+
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			break
+		}
+
+		for i := range a {
+			ops = diff(ops, path+"/"+strconv.Itoa(i), a[i], b[i])
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, patchOp("replace", path, b))
+	}
+	return ops
+}
+
+func patchOp(op, path string, value interface{}) map[string]interface{} {
+	m := map[string]interface{}{"op": op, "path": path}
+	if op != "remove" {
+		m["value"] = value
+	}
+	return m
+}
+
+// Escape a key for a JSON Pointer, as in RFC 6901.
+func escapePointer(k string) string {
+	return strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the patch from doc to put, if patches are kept, and stores it in
+// put when they're kept inline.
+func (ka *KubistAgent) patch(doc, put map[string]interface{}) ([]interface{}, error) {
+	if ka.Patches == PatchOff {
+		return nil, nil
+	}
+
+	patch, err := jsonPatch(doc, put)
+	if err != nil {
+		return nil, err
+	}
+
+	if ka.Patches == PatchInline {
+		setField(put, patch, lastPatchFields)
+	}
+	return patch, nil
+}
+
+// Write a change event for each patch to a document that was written.
+// Events that were already written, by an earlier attempt, are left alone.
+func (ka *KubistAgent) recordChanges(changes []change, written map[string]bool) {
+	if ka.Patches != PatchDocument || ka.ChangeEvents == nil {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var docs []couchdb.Body
+	for _, c := range changes {
+		if c.Patch == nil || !written[c.Id] {
+			continue
+		}
+
+		docs = append(docs, couchdb.Body{
+			"_id":             c.Id + "@" + c.ResourceVersion,
+			"id":              c.Id,
+			"resourceVersion": c.ResourceVersion,
+			"type":            string(c.Type),
+			"patch":           c.Patch,
+			"timestamp":       now,
+		})
+	}
+
+	if len(docs) == 0 {
+		return
+	}
+
+	results, err := ka.ChangeEvents.BulkDocs(docs)
+	if err != nil {
+		fmt.Printf("[!] Writing change events: %s\n", err.Error())
+		return
+	}
+
+	for _, result := range results {
+		if !result.Ok && !result.Conflict() {
+			fmt.Printf("[!] Writing change event %s: %s\n", result.Id, result.Error)
+		}
+	}
+}
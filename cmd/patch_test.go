@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestJsonPatch(t *testing.T) {
+	from := map[string]interface{}{
+		"_id":  "Pod/default/pod",
+		"_rev": "1-fake",
+		"metadata": map[string]interface{}{
+			"resourceVersion": "1",
+			"labels":          map[string]interface{}{"app": "web", "app.kubernetes.io/part-of": "shop"},
+		},
+		"spec": map[string]interface{}{
+			"replicas": float64(3),
+			"ports":    []interface{}{float64(80), float64(443)},
+			"args":     []interface{}{"-v"},
+		},
+		"kubist": map[string]interface{}{
+			"lastPatch": []interface{}{},
+		},
+	}
+
+	to := map[string]interface{}{
+		"_id": "Pod/default/pod",
+		"metadata": map[string]interface{}{
+			"resourceVersion": "2",
+			"labels":          map[string]interface{}{"app": "web", "tier": "front"},
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+			"ports":    []interface{}{int64(80), int64(8443)},
+			"args":     []interface{}{"-v", "-x"},
+		},
+	}
+
+	patch, err := jsonPatch(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, patch, []interface{}{
+		map[string]interface{}{"op": "test", "path": "/metadata/resourceVersion", "value": "1"},
+		map[string]interface{}{"op": "remove", "path": "/metadata/labels/app.kubernetes.io~1part-of"},
+		map[string]interface{}{"op": "add", "path": "/metadata/labels/tier", "value": "front"},
+		map[string]interface{}{"op": "replace", "path": "/metadata/resourceVersion", "value": "2"},
+		map[string]interface{}{"op": "replace", "path": "/spec/args", "value": []interface{}{"-v", "-x"}},
+		map[string]interface{}{"op": "replace", "path": "/spec/ports/1", "value": float64(8443)},
+	})
+
+	// from and to are left alone
+	_, exists := from["_rev"]
+	assert.Equal(t, exists, true)
+	assert.Equal(t, to["spec"].(map[string]interface{})["replicas"], int64(3))
+}
+
+func TestKubistAgent_Patches(t *testing.T) {
+	db := newFakeDatabase()
+	changesDb := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.Patches = PatchInline
+
+	id := "Pod/default/pod"
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 1)})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Updated, "pod", 2)})
+
+	replace := map[string]interface{}{"op": "replace", "path": "/metadata/resourceVersion", "value": "2"}
+	patch, _ := getField(db.docs[id], lastPatchFields)
+	assert.Equal(t, patch, []interface{}{
+		map[string]interface{}{"op": "test", "path": "/metadata/resourceVersion", "value": "1"},
+		replace,
+	})
+
+	// the previous patch isn't part of the next one
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Updated, "pod", 3)})
+	patch, _ = getField(db.docs[id], lastPatchFields)
+	assert.Equal(t, len(patch.([]interface{})), 2)
+
+	ka.Patches = PatchDocument
+	ka.ChangeEvents = changesDb
+	ka.applyBatch([]kubernetes.ResourceDelta{
+		testDelta(cache.Updated, "pod", 4),
+		testDelta(cache.Updated, "pod", 5),
+	})
+
+	_, exists := getField(db.docs[id], lastPatchFields)
+	assert.Equal(t, exists, false)
+
+	// an event for each update, even when a later one replaced it
+	assert.Equal(t, len(changesDb.docs), 2)
+	assert.Equal(t, changesDb.docs[id+"@5"]["patch"], []interface{}{
+		map[string]interface{}{"op": "test", "path": "/metadata/resourceVersion", "value": "4"},
+		map[string]interface{}{"op": "replace", "path": "/metadata/resourceVersion", "value": "5"},
+	})
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Fields removed from every object before it's written. They're large and
+// change often, without telling anyone much.
+var DefaultPrune = []string{
+	"metadata.managedFields",
+	"metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']",
+}
+
+// Fields that change without anything else changing, so a change to them
+// alone isn't written.
+var DefaultIgnoreChanges = []string{
+	"metadata.resourceVersion",
+	"status.conditions[*].lastHeartbeatTime",
+	"metadata.annotations['control-plane.alpha.kubernetes.io/leader']",
+	"kubist.observedAt",
+}
+
+// Parses a list of field paths from flags or config.
+func parseFieldPaths(paths []string) ([]FieldPath, error) {
+	fps := make([]FieldPath, 0, len(paths))
+	for _, p := range paths {
+		fp, err := ParseFieldPath(p)
+		if err != nil {
+			return nil, err
+		}
+		fps = append(fps, fp)
+	}
+	return fps, nil
+}
+
+// Remove the Prune fields from the object in delta.
+func (ka *KubistAgent) prune(delta kubernetes.ResourceDelta) {
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	for _, fp := range ka.Prune {
+		fp.Drop(rsrc.Object)
+	}
+}
+
+// Returns true if put only differs from the stored doc in fields that are
+// pruned or whose changes are ignored, so writing it would only add a
+// revision.
+func (ka *KubistAgent) unchanged(doc, put map[string]interface{}) bool {
+	a, err := ka.comparable(doc)
+	if err != nil {
+		return false
+	}
+
+	b, err := ka.comparable(put)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(a, b)
+}
+
+// Returns obj as JSON without the fields unchanged ignores. Encoding
+// sorts object keys, and numbers from CouchDB and Kubernetes encode alike.
+func (ka *KubistAgent) comparable(obj map[string]interface{}) ([]byte, error) {
+	c, err := patchable(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fp := range ka.Prune {
+		fp.Drop(c)
+	}
+	for _, fp := range ka.IgnoreChanges {
+		fp.Drop(c)
+	}
+
+	return json.Marshal(c)
+}
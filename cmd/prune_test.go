@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestKubistAgent_unchanged(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.Prune = []FieldPath{mustFieldPath("metadata.managedFields")}
+	ka.IgnoreChanges = []FieldPath{
+		mustFieldPath("metadata.resourceVersion"),
+		mustFieldPath("status.conditions[*].lastHeartbeatTime"),
+	}
+
+	node := func(typ cache.DeltaType, rv, heartbeat, ready string) kubernetes.ResourceDelta {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"kind": "Node",
+			"status": map[string]interface{}{
+				"conditions": []interface{}{
+					map[string]interface{}{
+						"type":              "Ready",
+						"status":            ready,
+						"lastHeartbeatTime": heartbeat,
+					},
+				},
+			},
+		}}
+		obj.SetName("worker-1")
+		obj.SetResourceVersion(rv)
+
+		return kubernetes.ResourceDelta{Delta: cache.Delta{Type: typ, Object: obj}}
+	}
+
+	// written before pruning was configured
+	added := node(cache.Added, "1", "10:00", "True")
+	unstructured.SetNestedField(added.Object.(*unstructured.Unstructured).Object,
+		[]interface{}{map[string]interface{}{"manager": "kubelet"}}, "metadata", "managedFields")
+	ka.applyBatch([]kubernetes.ResourceDelta{added})
+
+	ka.applyBatch([]kubernetes.ResourceDelta{node(cache.Updated, "2", "10:01", "True")})
+	assert.Equal(t, db.writes["Node/worker-1"], []string{"1"})
+
+	ka.applyBatch([]kubernetes.ResourceDelta{node(cache.Updated, "3", "10:02", "False")})
+	assert.Equal(t, db.writes["Node/worker-1"], []string{"1", "3"})
+}
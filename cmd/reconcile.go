@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+)
+
+// How the agent handles documents left behind by objects that were deleted
+// while it wasn't watching.
+type ReconcileMode string
+
+const (
+	ReconcileOff    ReconcileMode = "off"
+	ReconcileDryRun ReconcileMode = "dry-run"
+	ReconcileDelete ReconcileMode = "delete"
+)
+
+var DefaultReconcileMode = ReconcileDelete
+
+func ParseReconcileMode(s string) (ReconcileMode, error) {
+	switch m := ReconcileMode(s); m {
+	case ReconcileOff, ReconcileDryRun, ReconcileDelete:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown reconcile mode %#v", s)
+	}
+}
+
+// Find documents for objects that are missing from a full list, and delete
+// them. Only documents no newer than the list are orphans; anything newer
+// was written by a watch event after the list.
+func (ka *KubistAgent) reconcile(list kubernetes.ListResult) {
+	if ka.Reconcile == ReconcileOff || list.Kind == "" {
+		return
+	}
+
+	ka.deleteOrphans(list, ka.Reconcile == ReconcileDryRun)
+}
+
+// Delete the documents found by findOrphans, or only report them if dryRun
+// is set.
+func (ka *KubistAgent) deleteOrphans(list kubernetes.ListResult, dryRun bool) {
+	orphans, err := ka.findOrphans(list)
+	if err != nil {
+		fmt.Printf("[!] RECONCILE %s: %s\n", list.Kind, err.Error())
+		return
+	}
+
+	// deletes go through the aggregator, which closes ka.ch on Stop
+	ch := make(chan kubernetes.ResourceDelta)
+	if !dryRun {
+		if err := ka.Watchers.Add(ch); err != nil {
+			return // stopped
+		}
+		defer close(ch)
+	}
+
+	for _, doc := range orphans {
+		if dryRun {
+			fmt.Printf("[~] RECONCILE %s: orphaned (dry run)\n", doc["_id"])
+			continue
+		}
+
+		fmt.Printf("[~] RECONCILE %s: orphaned\n", doc["_id"])
+		id, _ := doc["_id"].(string)
+
+		// like a delete the watcher missed, it happened by the time of the
+		// list, and the document holds the object's last known state
+		obj := &unstructured.Unstructured{Object: doc}
+		obj.SetResourceVersion(list.ResourceVersion)
+
+		delta := kubernetes.ResourceDelta{
+			Delta: cache.Delta{
+				Type:   cache.Deleted,
+				Object: obj,
+			},
+			Resource:          list.Resource,
+			Namespace:         list.Namespace,
+			FinalStateUnknown: true,
+			DocumentId:        id,
+		}
+
+		select {
+		case ch <- delta:
+		case <-ka.stop:
+			return
+		}
+	}
+
+	fmt.Printf("[+] RECONCILE %s: %d orphaned documents\n", list.Kind, len(orphans))
+}
+
+func (ka *KubistAgent) findOrphans(list kubernetes.ListResult) ([]couchdb.Body, error) {
+	// only documents with ids starting with what's known about the list
+	// are read, but whatever the scheme, each is checked by its fields
+	prefix := clusterPrefix(ka.Cluster) + ka.IdScheme.prefix(map[string]string{
+		"group":     coreGroup(list.Resource.Group),
+		"version":   list.Resource.Version,
+		"kind":      list.Kind,
+		"namespace": list.Namespace,
+	})
+
+	// without a resourceVersion, every unlisted document is an orphan
+	listRv := -1
+	if list.ResourceVersion != "" {
+		rv, err := parseRv(list.ResourceVersion)
+		if err != nil {
+			return nil, err
+		}
+		listRv = rv
+	}
+
+	dbs, err := ka.databases(list.Resource, list.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []couchdb.Body
+	for _, db := range dbs {
+		found, err := ka.findOrphansIn(db, list, prefix, listRv)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, found...)
+	}
+
+	return orphans, nil
+}
+
+func (ka *KubistAgent) findOrphansIn(db couchdb.DatabaseInterface, list kubernetes.ListResult, prefix string, listRv int) ([]couchdb.Body, error) {
+	var orphans []couchdb.Body
+
+	opts := &couchdb.AllDocsOptions{
+		StartKey:    prefix,
+		EndKey:      prefix + "\ufff0",
+		IncludeDocs: true,
+		Limit:       500,
+	}
+
+	for opts != nil {
+		res, err := db.AllDocs(*opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range res.Rows {
+			if row.Doc == nil || strings.HasPrefix(row.Id, "_design/") {
+				continue
+			}
+
+			obj := &unstructured.Unstructured{Object: row.Doc}
+			if obj.GetKind() != list.Kind || objectCluster(row.Doc) != ka.Cluster ||
+				(list.Namespace != "" && obj.GetNamespace() != list.Namespace) {
+				continue
+			}
+
+			// another group may serve the same kind
+			if gv, err := schema.ParseGroupVersion(obj.GetAPIVersion()); err != nil ||
+				gv.Group != list.Resource.Group {
+				continue
+			}
+
+			key := obj.GetName()
+			if ns := obj.GetNamespace(); ns != "" {
+				key = ns + "/" + key
+			}
+
+			// with ids by uid, an object that was recreated has a new
+			// document, and the old one is an orphan
+			listed := list.Keys[key]
+			if listed && list.UIDs != nil && ka.IdScheme.uses("uid") {
+				listed = list.UIDs[string(obj.GetUID())]
+			}
+			if listed {
+				continue
+			}
+
+			if ka.SoftDelete && isTombstone(row.Doc) {
+				continue // already deleted
+			}
+
+			if listRv >= 0 {
+				if rv, err := parseRv(obj.GetResourceVersion()); err != nil || rv > listRv {
+					continue
+				}
+			}
+
+			orphans = append(orphans, row.Doc)
+		}
+
+		opts = opts.NextPage(res)
+	}
+
+	return orphans, nil
+}
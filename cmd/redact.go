@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// What a Redaction does to the values at its path.
+type RedactAction string
+
+const (
+	// Remove the field, or the list item.
+	RedactDrop RedactAction = "drop"
+	// Replace the value with its SHA-256, so changes can still be seen.
+	RedactHash RedactAction = "hash"
+	// Replace the value with redactedMask.
+	RedactMask RedactAction = "mask"
+)
+
+const redactedMask = "********"
+
+// A Redaction removes or obscures the values at a FieldPath in an object
+// before it's written to CouchDB.
+type Redaction struct {
+	Path   string
+	Action RedactAction
+
+	path FieldPath
+}
+
+func NewRedaction(p string, action RedactAction) (Redaction, error) {
+	switch action {
+	case RedactDrop, RedactHash, RedactMask:
+	default:
+		return Redaction{}, fmt.Errorf("unknown redact action %#v", action)
+	}
+
+	fp, err := ParseFieldPath(p)
+	if err != nil {
+		return Redaction{}, err
+	}
+
+	return Redaction{Path: p, Action: action, path: fp}, nil
+}
+
+func mustRedaction(p string, action RedactAction) Redaction {
+	r, err := NewRedaction(p, action)
+	if err != nil {
+		panic(err.Error())
+	}
+	return r
+}
+
+// Environment variables whose values are dropped from pod specs, whatever
+// the case of their names.
+var DefaultSensitiveEnv = []string{
+	"*PASSWORD*", "*PASSWD*", "*SECRET*", "*TOKEN*", "*API_KEY*", "*PRIVATE_KEY*", "*CREDENTIALS*",
+}
+
+// Redactions for objects of each kind, unless their resource opts out.
+var DefaultRedactions = map[string][]Redaction{
+	"Secret": {
+		mustRedaction("data", RedactDrop),
+		mustRedaction("stringData", RedactDrop),
+		// kubectl apply keeps a copy of the whole object here
+		mustRedaction("metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']", RedactDrop),
+	},
+	"Pod":                   podSpecRedactions("spec"),
+	"PodTemplate":           podSpecRedactions("template.spec"),
+	"ReplicationController": podSpecRedactions("spec.template.spec"),
+	"ReplicaSet":            podSpecRedactions("spec.template.spec"),
+	"Deployment":            podSpecRedactions("spec.template.spec"),
+	"StatefulSet":           podSpecRedactions("spec.template.spec"),
+	"DaemonSet":             podSpecRedactions("spec.template.spec"),
+	"Job":                   podSpecRedactions("spec.template.spec"),
+	"CronJob":               podSpecRedactions("spec.jobTemplate.spec.template.spec"),
+}
+
+// Returns redactions dropping sensitive env values from the pod spec at p.
+func podSpecRedactions(p string) []Redaction {
+	var redactions []Redaction
+	for _, containers := range []string{"containers", "initContainers"} {
+		for _, name := range DefaultSensitiveEnv {
+			env := fmt.Sprintf("%s.%s[*].env[name~=%s].value", p, containers, name)
+			redactions = append(redactions, mustRedaction(env, RedactDrop))
+		}
+	}
+	return redactions
+}
+
+// Redact the values at r's path in obj, which is changed in place.
+func (r Redaction) Apply(obj map[string]interface{}) {
+	redactPath(obj, r.path.segments, r.Action)
+}
+
+func redactValue(v interface{}, action RedactAction) interface{} {
+	if action == RedactMask {
+		return redactedMask
+	}
+
+	var b []byte
+	if s, ok := v.(string); ok {
+		b = []byte(s)
+	} else {
+		b, _ = json.Marshal(v)
+	}
+
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Parses the "redact" list of a resource in the config file.
+func parseRedactions(raw interface{}) ([]Redaction, error) {
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+
+	redactions := make([]Redaction, 0, len(items))
+	for i, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[%d]: not an object", i)
+		}
+
+		p, _ := m["path"].(string)
+		action, _ := m["action"].(string)
+		if action == "" {
+			action = string(RedactDrop)
+		}
+
+		r, err := NewRedaction(p, RedactAction(action))
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %s", i, err.Error())
+		}
+		redactions = append(redactions, r)
+	}
+
+	return redactions, nil
+}
+
+// Redact the object in delta with the defaults for its kind, then the
+// redactions configured for its resource.
+func (ka *KubistAgent) redact(delta kubernetes.ResourceDelta) {
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	if !ka.NoDefaultRedactions[delta.Resource] {
+		for _, r := range DefaultRedactions[rsrc.GetKind()] {
+			r.Apply(rsrc.Object)
+		}
+	}
+
+	for _, r := range ka.Redactions[delta.Resource] {
+		r.Apply(rsrc.Object)
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func redactDelta(ka *KubistAgent, gvr schema.GroupVersionResource, obj map[string]interface{}) {
+	ka.redact(kubernetes.ResourceDelta{
+		Delta:    cache.Delta{Type: cache.Added, Object: &unstructured.Unstructured{Object: obj}},
+		Resource: gvr,
+	})
+}
+
+func TestKubistAgent_redact(t *testing.T) {
+	ka := newTestAgent(newFakeDatabase())
+	secrets := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+	secret := map[string]interface{}{
+		"kind": "Secret",
+		"metadata": map[string]interface{}{
+			"name": "db",
+			"annotations": map[string]interface{}{
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				"team": "payments",
+			},
+		},
+		"data": map[string]interface{}{"password": "aHVudGVyMg=="},
+	}
+	redactDelta(ka, secrets, secret)
+	assert.Equal(t, secret, map[string]interface{}{
+		"kind": "Secret",
+		"metadata": map[string]interface{}{
+			"name":        "db",
+			"annotations": map[string]interface{}{"team": "payments"},
+		},
+	})
+
+	pod := map[string]interface{}{
+		"kind": "Pod",
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name": "web",
+					"env": []interface{}{
+						map[string]interface{}{"name": "DB_PASSWORD", "value": "hunter2"},
+						map[string]interface{}{"name": "db_password", "value": "hunter2"},
+						map[string]interface{}{"name": "ApiToken", "value": "abc123"},
+						map[string]interface{}{"name": "PORT", "value": "8080"},
+					},
+				},
+			},
+		},
+	}
+	redactDelta(ka, testResource, pod)
+	assert.Equal(t, pod["spec"], map[string]interface{}{
+		"containers": []interface{}{
+			map[string]interface{}{
+				"name": "web",
+				"env": []interface{}{
+					map[string]interface{}{"name": "DB_PASSWORD"},
+					map[string]interface{}{"name": "db_password"},
+					map[string]interface{}{"name": "ApiToken"},
+					map[string]interface{}{"name": "PORT", "value": "8080"},
+				},
+			},
+		},
+	})
+
+	// configured redactions are applied on top of the defaults
+	ka.Redactions = map[schema.GroupVersionResource][]Redaction{
+		secrets: {
+			mustRedaction("metadata.annotations.team", RedactMask),
+			mustRedaction("data.password", RedactHash),
+			mustRedaction("data['tls.key']", RedactMask),
+		},
+	}
+
+	newSecret := func() map[string]interface{} {
+		return map[string]interface{}{
+			"kind": "Secret",
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{"team": "payments"},
+			},
+			"data": map[string]interface{}{"password": "hunter2", "tls.key": "key", "user": "admin"},
+		}
+	}
+
+	secret = newSecret()
+	redactDelta(ka, secrets, secret)
+	assert.Equal(t, secret, map[string]interface{}{
+		"kind": "Secret",
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"team": redactedMask},
+		},
+	})
+
+	// unless the resource opts out of them
+	ka.NoDefaultRedactions = map[schema.GroupVersionResource]bool{secrets: true}
+
+	secret = newSecret()
+	redactDelta(ka, secrets, secret)
+	assert.Equal(t, secret["data"], map[string]interface{}{
+		"password": "sha256:f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7",
+		"tls.key":  redactedMask,
+		"user":     "admin",
+	})
+}
+
+func TestNewRedaction(t *testing.T) {
+	var tests = []struct {
+		path string
+		err  string
+	}{
+		{"spec.containers[*].env[name=*TOKEN*].value", ""},
+		{"metadata.annotations['example.com/key']", ""},
+		{"spec.containers[*].env[name~=*token*].value", ""},
+		{"spec.containers[*].env[name~=[].value", `path "spec.containers[*].env[name~=[].value": bad pattern "["`},
+		{"spec..replicas", `path "spec..replicas": empty field name`},
+		{"spec.containers[*", `path "spec.containers[*": unclosed [`},
+		{"spec.containers[0]", `path "spec.containers[0]": can't parse [0]`},
+		{"", "empty path"},
+	}
+
+	for _, test := range tests {
+		_, err := NewRedaction(test.path, RedactDrop)
+		if test.err == "" {
+			assert.Equal(t, err, nil, test.path)
+		} else {
+			assert.Equal(t, err.Error(), test.err)
+		}
+	}
+
+	_, err := NewRedaction("data", "shred")
+	assert.Equal(t, err.Error(), `unknown redact action "shred"`)
+}
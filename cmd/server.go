@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/slushie/kubist-agent/couchdb"
+	"net/http"
+)
+
+// Returns the handler for the agents' HTTP endpoints.
+func newServeMux(agents []*KubistAgent, cc *couchdb.Client) *http.ServeMux {
+	prometheus.MustRegister(queueDepthGauge(agents))
+
+	var live, ready []func() error
+	for _, ka := range agents {
+		ka := ka
+		live = append(live, func() error {
+			return ka.checkLive(DefaultLivenessTimeout)
+		})
+		ready = append(ready, ka.checkSynced)
+	}
+	ready = append(ready, func() error {
+		return checkCouchDb(cc)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(live...))
+	mux.Handle("/readyz", healthHandler(ready...))
+	return mux
+}
+
+// Serve the agents' HTTP endpoints on addr in the background.
+func serveHTTP(addr string, agents []*KubistAgent, cc *couchdb.Client) {
+	srv := &http.Server{Addr: addr, Handler: newServeMux(agents, cc)}
+
+	go func() {
+		fmt.Printf("[+] Serving metrics and health checks on %s\n", addr)
+		if err := srv.ListenAndServe(); err != nil {
+			fmt.Printf("[!] HTTP server: %s\n", err.Error())
+		}
+	}()
+}
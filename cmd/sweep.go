@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"time"
+)
+
+// How often expired tombstones and history revisions are removed.
+var DefaultSweepInterval = time.Hour
+
+// Delete expired tombstones and history revisions in the databases of the
+// running agents. Each database is swept once, however many of the agents'
+// clusters share it.
+func sweep(agents []*KubistAgent) {
+	swept := make(map[string]bool)
+	pruned := make(map[*HistoryStore]bool)
+
+	for _, ka := range agents {
+		// a standby's databases are swept by its leader
+		if !ka.isRunning() {
+			continue
+		}
+
+		if ka.History != nil && !pruned[ka.History] {
+			pruned[ka.History] = true
+			ka.History.Prune()
+		}
+
+		if !ka.SoftDelete || ka.TombstoneTTL <= 0 {
+			continue
+		}
+
+		dbs, err := ka.databases(schema.GroupVersionResource{}, "")
+		if err != nil {
+			fmt.Printf("[!] SWEEP: %s\n", err.Error())
+			continue
+		}
+
+		for _, db := range dbs {
+			if !swept[db.Name()] {
+				swept[db.Name()] = true
+				ka.sweepTombstonesIn(db)
+			}
+		}
+	}
+}
+
+// Sweep the agents' databases every interval, for as long as the process
+// runs.
+func sweepEvery(agents []*KubistAgent, interval time.Duration) {
+	for range time.Tick(interval) {
+		sweep(agents)
+	}
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/couchdb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"time"
+)
+
+var DefaultTombstoneTTL = 7 * 24 * time.Hour
+
+// Returns true if doc is a tombstone left by a deleted object.
+func isTombstone(doc map[string]interface{}) bool {
+	deleted, _ := unstructured.NestedBool(doc, "kubist", "deleted")
+	return deleted
+}
+
+// Returns a tombstone document for id, holding the final state of the
+// deleted object.
+func tombstone(id string, rsrc *unstructured.Unstructured) map[string]interface{} {
+	doc := rsrc.DeepCopy().Object
+	doc["_id"] = id
+	setField(doc, true, []string{"kubist", "deleted"})
+	setField(doc, time.Now().UTC().Format(time.RFC3339), []string{"kubist", "deletedAt"})
+	return doc
+}
+
+// Delete tombstones in db older than TombstoneTTL, whichever cluster they
+// belong to, a page of BatchSize documents at a time. A tombstone that
+// changed since it was read, because its object was recreated, is left
+// alone.
+func (ka *KubistAgent) sweepTombstonesIn(db couchdb.DatabaseInterface) {
+	cutoff := time.Now().Add(-ka.TombstoneTTL)
+
+	last := ""
+	for {
+		// each page starts from the last id read, rather than skipping it,
+		// since it may have been deleted, so it reads one more
+		limit := ka.BatchSize
+		if last != "" {
+			limit++
+		}
+
+		res, err := db.AllDocs(couchdb.AllDocsOptions{StartKey: last, IncludeDocs: true, Limit: limit})
+		if err != nil {
+			fmt.Printf("[!] SWEEP: %s\n", err.Error())
+			return
+		}
+
+		var expired []couchdb.Body
+		for _, row := range res.Rows {
+			if last != "" && row.Id == last {
+				continue // read with the previous page
+			} else if row.Doc == nil || !isTombstone(row.Doc) {
+				continue
+			}
+
+			deletedAt, _ := unstructured.NestedString(row.Doc, "kubist", "deletedAt")
+			if t, err := time.Parse(time.RFC3339, deletedAt); err == nil && t.Before(cutoff) {
+				expired = append(expired, couchdb.Body{
+					"_id":      row.Id,
+					"_rev":     row.Value.Rev,
+					"_deleted": true,
+				})
+			}
+		}
+
+		if len(expired) > 0 {
+			results, err := db.BulkDocs(expired)
+			if err != nil {
+				fmt.Printf("[!] SWEEP: %s\n", err.Error())
+				return
+			}
+
+			deleted := 0
+			for _, result := range results {
+				if result.Ok {
+					deleted++
+				}
+			}
+
+			fmt.Printf("[~] SWEEP: deleted %d tombstones\n", deleted)
+		}
+
+		if len(res.Rows) < limit {
+			return
+		}
+		last = res.Rows[len(res.Rows)-1].Id
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+)
+
+func TestKubistAgent_SoftDelete(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.SoftDelete = true
+	ka.TombstoneTTL = time.Hour
+
+	id := "Pod/default/pod"
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 1)})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Deleted, "pod", 2)})
+	assert.Equal(t, db.writes[id], []string{"1", "2"})
+	assert.Equal(t, isTombstone(db.docs[id]), true)
+
+	// deleting again, or replaying an older add, leaves the tombstone
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Deleted, "pod", 2)})
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 1)})
+	assert.Equal(t, db.writes[id], []string{"1", "2"})
+
+	// recreated
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "pod", 3)})
+	assert.Equal(t, db.writes[id], []string{"1", "2", "3"})
+	assert.Equal(t, isTombstone(db.docs[id]), false)
+
+	ka.applyBatch([]kubernetes.ResourceDelta{
+		testDelta(cache.Deleted, "pod", 4),
+		testDelta(cache.Added, "other", 5),
+		testDelta(cache.Deleted, "other", 6),
+	})
+
+	// only tombstones past their TTL are swept
+	setField(db.docs[id], time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339),
+		[]string{"kubist", "deletedAt"})
+	ka.running = true
+	sweep([]*KubistAgent{ka})
+
+	_, exists := db.docs[id]
+	assert.Equal(t, exists, false)
+	assert.Equal(t, isTombstone(db.docs["Pod/default/other"]), true)
+}
+
+func TestKubistAgent_SweepPages(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.SoftDelete = true
+	ka.TombstoneTTL = time.Hour
+	ka.BatchSize = 1
+
+	for i, name := range []string{"a", "b", "c", "d"} {
+		ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, name, 2*i+1)})
+		ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Deleted, name, 2*i+2)})
+	}
+	ka.applyBatch([]kubernetes.ResourceDelta{testDelta(cache.Added, "e", 9)})
+
+	for _, doc := range db.docs {
+		setField(doc, time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339),
+			[]string{"kubist", "deletedAt"})
+	}
+
+	// tombstones are read a page at a time, and none are skipped when the
+	// one a page ended with is deleted
+	ka.running = true
+	sweep([]*KubistAgent{ka})
+	assert.Equal(t, len(db.docs), 1)
+	assert.Equal(t, db.docs["Pod/default/e"] != nil, true)
+}
+
+func TestKubistAgent_SoftDeleteFinalStateUnknown(t *testing.T) {
+	db := newFakeDatabase()
+	ka := newTestAgent(db)
+	ka.SoftDelete = true
+
+	id := "Pod/default/pod"
+	added := testDelta(cache.Added, "pod", 1)
+	setField(added.Object.(*unstructured.Unstructured).Object, "web-1", []string{"spec", "nodeName"})
+	ka.applyBatch([]kubernetes.ResourceDelta{added})
+
+	// the tombstone keeps the last known state, not the watcher's stand-in
+	processDeltas(ka, testTombstone("pod", 10))
+	assert.Equal(t, isTombstone(db.docs[id]), true)
+
+	nodeName, _ := getField(db.docs[id], []string{"spec", "nodeName"})
+	assert.Equal(t, nodeName, "web-1")
+}
+
+func TestSweep_SharedDatabase(t *testing.T) {
+	client := fakeClient{}
+	db := client.Database("kubist").(*fakeDatabase)
+
+	var agents []*KubistAgent
+	for _, cluster := range []string{"east", "west"} {
+		ka := newTestAgent(db)
+		ka.Cluster = cluster
+		ka.SoftDelete = true
+		ka.TombstoneTTL = time.Hour
+		ka.running = true
+
+		for i, typ := range []cache.DeltaType{cache.Added, cache.Deleted} {
+			delta := testDelta(typ, "pod", i+1)
+			ka.labelCluster(delta)
+			ka.applyBatch([]kubernetes.ResourceDelta{delta})
+		}
+		agents = append(agents, ka)
+	}
+
+	for _, doc := range db.docs {
+		setField(doc, time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339),
+			[]string{"kubist", "deletedAt"})
+	}
+
+	// one pass over the database sweeps every cluster's tombstones
+	db.scans = 0
+	sweep(agents)
+	assert.Equal(t, db.scans, 1)
+	assert.Equal(t, len(db.docs), 0)
+}
@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Transformer changes objects after they're pruned and redacted, and
+// before they're written to CouchDB.
+type Transformer interface {
+	// Change obj, the object in delta, in place.
+	Transform(delta kubernetes.ResourceDelta, obj map[string]interface{}) error
+}
+
+type TransformerFunc func(delta kubernetes.ResourceDelta, obj map[string]interface{}) error
+
+func (f TransformerFunc) Transform(delta kubernetes.ResourceDelta, obj map[string]interface{}) error {
+	return f(delta, obj)
+}
+
+// Fields the agent needs to write a document, which transforms can't remove.
+var requiredFields = [][]string{
+	{"apiVersion"},
+	{"kind"},
+	{"metadata", "name"},
+	{"metadata", "namespace"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "uid"},
+	clusterFields,
+}
+
+// Values that can be computed for a field by NewSetField.
+var computedValues = map[string]func(kubernetes.ResourceDelta) interface{}{
+	"observedAt": func(kubernetes.ResourceDelta) interface{} {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	"resource": func(delta kubernetes.ResourceDelta) interface{} {
+		return resourceKey(delta.Resource)
+	},
+	"deltaType": func(delta kubernetes.ResourceDelta) interface{} {
+		return string(delta.Type)
+	},
+}
+
+// Returns a Transformer that applies each of ts, in order, to objects of
+// gvr only.
+func ForResource(gvr schema.GroupVersionResource, ts ...Transformer) Transformer {
+	return TransformerFunc(func(delta kubernetes.ResourceDelta, obj map[string]interface{}) error {
+		if delta.Resource != gvr {
+			return nil
+		}
+
+		for _, t := range ts {
+			if err := t.Transform(delta, obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns a Transformer that keeps only the fields at paths, and the fields
+// the agent needs.
+func NewProjection(paths ...string) (Transformer, error) {
+	keep := append([][]string{}, requiredFields...)
+	for _, p := range paths {
+		fields, err := parseFields(p)
+		if err != nil {
+			return nil, err
+		}
+		keep = append(keep, fields)
+	}
+
+	return TransformerFunc(func(_ kubernetes.ResourceDelta, obj map[string]interface{}) error {
+		projected := make(map[string]interface{})
+		for _, fields := range keep {
+			if v, exists := getField(obj, fields); exists {
+				setField(projected, v, fields)
+			}
+		}
+
+		for k := range obj {
+			delete(obj, k)
+		}
+		for k, v := range projected {
+			obj[k] = v
+		}
+		return nil
+	}), nil
+}
+
+// Returns a Transformer that moves the value at from to to.
+func NewRename(from, to string) (Transformer, error) {
+	fromFields, err := parseFields(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toFields, err := parseFields(to)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, required := range requiredFields {
+		if isPrefix(fromFields, required) || isPrefix(toFields, required) {
+			return nil, fmt.Errorf("can't rename %s to %s, the agent needs %s",
+				from, to, strings.Join(required, "."))
+		}
+	}
+
+	return TransformerFunc(func(_ kubernetes.ResourceDelta, obj map[string]interface{}) error {
+		if v, exists := getField(obj, fromFields); exists {
+			unstructured.RemoveNestedField(obj, fromFields...)
+			setField(obj, v, toFields)
+		}
+		return nil
+	}), nil
+}
+
+// Returns a Transformer that sets the field at p to value, or to the
+// computed value named by from if value is nil.
+func NewSetField(p string, value interface{}, from string) (Transformer, error) {
+	fields, err := parseFields(p)
+	if err != nil {
+		return nil, err
+	}
+
+	compute := func(kubernetes.ResourceDelta) interface{} { return value }
+	if value == nil {
+		var exists bool
+		if compute, exists = computedValues[from]; !exists {
+			return nil, fmt.Errorf("unknown computed value %#v, expected one of %s",
+				from, strings.Join(computedValueNames(), ", "))
+		}
+	}
+
+	for _, required := range requiredFields {
+		if isPrefix(fields, required) {
+			return nil, fmt.Errorf("can't set %s, the agent needs it", p)
+		}
+	}
+
+	return TransformerFunc(func(delta kubernetes.ResourceDelta, obj map[string]interface{}) error {
+		setField(obj, compute(delta), fields)
+		return nil
+	}), nil
+}
+
+// Returns a Transformer that replaces the object at p with a single level
+// of keys joined by dots, like {"a.b": 1} for {"a": {"b": 1}}. A list at p
+// becomes an object keyed by the key field of each item first, like the
+// type of each status condition.
+func NewFlatten(p, key string) (Transformer, error) {
+	fields, err := parseFields(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return TransformerFunc(func(_ kubernetes.ResourceDelta, obj map[string]interface{}) error {
+		v, exists := getField(obj, fields)
+		if !exists {
+			return nil
+		}
+
+		if list, ok := v.([]interface{}); ok && key != "" {
+			keyed := make(map[string]interface{}, len(list))
+			for _, item := range list {
+				if m, ok := item.(map[string]interface{}); ok {
+					if k, ok := m[key].(string); ok {
+						delete(m, key)
+						keyed[k] = m
+					}
+				}
+			}
+			v = keyed
+		}
+
+		if m, ok := v.(map[string]interface{}); ok {
+			flat := make(map[string]interface{})
+			flatten(flat, "", m)
+			setField(obj, flat, fields)
+		}
+		return nil
+	}), nil
+}
+
+func flatten(flat map[string]interface{}, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flatten(flat, prefix+k+".", child)
+		} else {
+			flat[prefix+k] = v
+		}
+	}
+}
+
+// Returns the field names in p, which can't select list items.
+func parseFields(p string) ([]string, error) {
+	fp, err := ParseFieldPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, len(fp.segments))
+	for i, seg := range fp.segments {
+		if seg.field == "" {
+			return nil, fmt.Errorf("path %#v: can't select list items here", p)
+		}
+		fields[i] = seg.field
+	}
+	return fields, nil
+}
+
+func isPrefix(a, b []string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func getField(obj map[string]interface{}, fields []string) (interface{}, bool) {
+	var v interface{} = obj
+	for _, field := range fields {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[field]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Set the field in obj, replacing anything in the way that isn't an object.
+func setField(obj map[string]interface{}, value interface{}, fields []string) {
+	m := obj
+	for _, field := range fields[:len(fields)-1] {
+		child, ok := m[field].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[field] = child
+		}
+		m = child
+	}
+	m[fields[len(fields)-1]] = value
+}
+
+// Parses the "transforms" list of a resource in the config file.
+func parseTransforms(raw interface{}) ([]Transformer, error) {
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+
+	transformers := make([]Transformer, 0, len(items))
+	for i, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[%d]: not an object", i)
+		}
+
+		str := func(key string) string {
+			s, _ := m[key].(string)
+			return s
+		}
+
+		var t Transformer
+		var err error
+		switch typ := str("type"); typ {
+		case "project":
+			var paths []string
+			if list, ok := m["paths"].([]interface{}); ok {
+				for _, p := range list {
+					if s, ok := p.(string); ok {
+						paths = append(paths, s)
+					}
+				}
+			}
+			t, err = NewProjection(paths...)
+		case "rename":
+			t, err = NewRename(str("from"), str("to"))
+		case "set":
+			t, err = NewSetField(str("path"), m["value"], str("from"))
+		case "flatten":
+			t, err = NewFlatten(str("path"), str("key"))
+		default:
+			err = fmt.Errorf("unknown transform type %#v", typ)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %s", i, err.Error())
+		}
+		transformers = append(transformers, t)
+	}
+
+	return transformers, nil
+}
+
+// Returns the names of the values a "set" transform can compute.
+func computedValueNames() []string {
+	names := make([]string, 0, len(computedValues))
+	for name := range computedValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply the Transformers to the object in delta.
+func (ka *KubistAgent) transform(delta kubernetes.ResourceDelta) error {
+	rsrc, ok := delta.Object.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+
+	for _, t := range ka.Transformers {
+		if err := t.Transform(delta, rsrc.Object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"github.com/magiconair/properties/assert"
+	"github.com/slushie/kubist-agent/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestKubistAgent_transform(t *testing.T) {
+	transforms, err := parseTransforms([]interface{}{
+		map[string]interface{}{"type": "project", "paths": []interface{}{"spec.replicas", "status"}},
+		map[string]interface{}{"type": "rename", "from": "spec.replicas", "to": "replicas"},
+		map[string]interface{}{"type": "flatten", "path": "status.conditions", "key": "type"},
+		map[string]interface{}{"type": "set", "path": "kubist.environment", "value": "prod"},
+		map[string]interface{}{"type": "set", "path": "kubist.resource", "from": "resource"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	ka := newTestAgent(newFakeDatabase())
+	ka.Transformers = []Transformer{ForResource(deployments, transforms...)}
+
+	newDeployment := func() *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":            "web",
+				"namespace":       "default",
+				"resourceVersion": "5",
+				"labels":          map[string]interface{}{"app": "web"},
+			},
+			"spec": map[string]interface{}{
+				"replicas": int64(3),
+				"template": map[string]interface{}{},
+			},
+			"status": map[string]interface{}{
+				"conditions": []interface{}{
+					map[string]interface{}{"type": "Available", "status": "True", "reason": "MinimumReplicasAvailable"},
+				},
+			},
+		}}
+	}
+
+	obj := newDeployment()
+	err = ka.transform(kubernetes.ResourceDelta{
+		Delta:    cache.Delta{Type: cache.Updated, Object: obj},
+		Resource: deployments,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, obj.Object, map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":            "web",
+			"namespace":       "default",
+			"resourceVersion": "5",
+		},
+		"spec":     map[string]interface{}{},
+		"replicas": int64(3),
+		"status": map[string]interface{}{
+			"conditions": map[string]interface{}{
+				"Available.status": "True",
+				"Available.reason": "MinimumReplicasAvailable",
+			},
+		},
+		"kubist": map[string]interface{}{
+			"environment": "prod",
+			"resource":    "apps/v1/deployments",
+		},
+	})
+
+	// other resources are left alone
+	obj = newDeployment()
+	ka.transform(kubernetes.ResourceDelta{
+		Delta:    cache.Delta{Type: cache.Updated, Object: obj},
+		Resource: testResource,
+	})
+	assert.Equal(t, obj.Object, newDeployment().Object)
+}
+
+func TestKubistAgent_transformIdSchemeUID(t *testing.T) {
+	projection, err := NewProjection("spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ka := newTestAgent(newFakeDatabase())
+	ka.Transformers = []Transformer{projection}
+
+	delta := testDelta(cache.Updated, "web", 1)
+	delta.Object.(*unstructured.Unstructured).SetUID(types.UID("8f1c"))
+	if err := ka.transform(delta); err != nil {
+		t.Fatal(err)
+	}
+
+	// the uid survives a projection that doesn't list it
+	id, err := IdSchemeUID.DocumentId(delta.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, id, "8f1c")
+}
+
+func TestParseTransforms(t *testing.T) {
+	var tests = []struct {
+		transform map[string]interface{}
+		err       string
+	}{
+		{
+			map[string]interface{}{"type": "rename", "from": "metadata.name", "to": "name"},
+			"[0]: can't rename metadata.name to name, the agent needs metadata.name",
+		},
+		{
+			map[string]interface{}{"type": "set", "path": "metadata", "value": "x"},
+			"[0]: can't set metadata, the agent needs it",
+		},
+		{
+			map[string]interface{}{"type": "set", "path": "kubist.cluster", "value": "prod"},
+			"[0]: can't set kubist.cluster, the agent needs it",
+		},
+		{
+			map[string]interface{}{"type": "set", "path": "kubist.when", "from": "now"},
+			`[0]: unknown computed value "now", expected one of deltaType, observedAt, resource`,
+		},
+		{
+			map[string]interface{}{"type": "project", "paths": []interface{}{"spec.containers[*]"}},
+			`[0]: path "spec.containers[*]": can't select list items here`,
+		},
+		{
+			map[string]interface{}{"type": "explode"},
+			`[0]: unknown transform type "explode"`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := parseTransforms([]interface{}{test.transform})
+		assert.Equal(t, err.Error(), test.err)
+	}
+}
@@ -10,12 +10,19 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Client struct {
 	*Auth
 	c   *http.Client
 	url *url.URL
+
+	// Called after every request with its method, the response status code,
+	// or 0 if no response was received, and how long the request took.
+	Observer func(method string, code int, elapsed time.Duration)
 }
 
 type Auth struct {
@@ -23,6 +30,7 @@ type Auth struct {
 }
 
 type ClientInterface interface {
+	AllDbs() ([]string, error)
 	Database(name string) DatabaseInterface
 }
 
@@ -34,6 +42,7 @@ type Database struct {
 }
 
 type DatabaseInterface interface {
+	Name() string
 	Exists() (bool, error)
 	Create() error
 	Drop() error
@@ -45,6 +54,8 @@ type DatabaseInterface interface {
 	Delete(doc Body) (*StatusObject, error)
 	Post(doc Body) (*StatusObject, error)
 	Put(id string, doc Body) (*StatusObject, error)
+	BulkDocs(docs []Body) ([]BulkResult, error)
+	AllDocs(opts AllDocsOptions) (*AllDocsResult, error)
 }
 
 var _ DatabaseInterface = &Database{}
@@ -58,6 +69,67 @@ var _ error = &StatusObject{}
 
 type Body map[string]interface{}
 
+// BulkResult is the outcome for a single document written by BulkDocs.
+type BulkResult struct {
+	Id     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Ok     bool   `json:"ok,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Returns true if the document was rejected because of a revision conflict.
+func (br BulkResult) Conflict() bool {
+	return br.Error == "conflict"
+}
+
+// AllDocsOptions are the query parameters for AllDocs. Zero values are
+// left out of the request.
+type AllDocsOptions struct {
+	// Only return rows for these document ids. This can't be combined with
+	// StartKey or EndKey.
+	Keys []string
+
+	StartKey    string
+	EndKey      string
+	Limit       int
+	Skip        int
+	IncludeDocs bool
+}
+
+// Returns the options to fetch the page following res, or nil if res was
+// the last page. Only requests with a Limit are paginated.
+func (o AllDocsOptions) NextPage(res *AllDocsResult) *AllDocsOptions {
+	if o.Limit <= 0 || len(o.Keys) > 0 || len(res.Rows) < o.Limit {
+		return nil
+	}
+
+	next := o
+	next.StartKey = res.Rows[len(res.Rows)-1].Key
+	next.Skip = 1
+	return &next
+}
+
+type AllDocsResult struct {
+	TotalRows int          `json:"total_rows"`
+	Offset    int          `json:"offset"`
+	Rows      []AllDocsRow `json:"rows"`
+}
+
+// AllDocsRow is a single document in an AllDocsResult. When querying by
+// Keys, missing documents have an Error of "not_found" and deleted
+// documents have Value.Deleted set.
+type AllDocsRow struct {
+	Id    string `json:"id"`
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+	Value struct {
+		Rev     string `json:"rev"`
+		Deleted bool   `json:"deleted,omitempty"`
+	} `json:"value"`
+	Doc Body `json:"doc,omitempty"`
+}
+
 func NewClient(baseUrl string, auth *Auth) (*Client, error) {
 	base, err := url.Parse(baseUrl)
 	if err != nil {
@@ -79,10 +151,38 @@ func (c *Client) Info() (*StatusObject, error) {
 	}
 }
 
+// Returns the names of every database on the server.
+func (c *Client) AllDbs() ([]string, error) {
+	res, err := c.request(http.MethodGet, "_all_dbs", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		if status, err := c.createStatusObject(res); err != nil {
+			return nil, err
+		} else {
+			return nil, status
+		}
+	}
+
+	var names []string
+	if err := c.decodeJsonBody(res, &names); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
 func (c *Client) Database(name string) DatabaseInterface {
 	return &Database{Client: c, name: url.QueryEscape(name)}
 }
 
+func (db *Database) Name() string {
+	name, _ := url.QueryUnescape(db.name)
+	return name
+}
+
 func (db *Database) Changes(changesCh chan<- Body, stopCh <-chan struct{}) error {
 	defer close(changesCh)
 
@@ -174,7 +274,7 @@ func (db *Database) Delete(doc Body) (*StatusObject, error) {
 
 	req.Header.Set("If-Match", rev)
 
-	res, err := db.c.Do(req)
+	res, err := db.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -201,7 +301,7 @@ func (db *Database) Put(id string, doc Body) (*StatusObject, error) {
 		req.Header.Set("If-Match", rev)
 	}
 
-	res, err := db.c.Do(req)
+	res, err := db.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -209,6 +309,91 @@ func (db *Database) Put(id string, doc Body) (*StatusObject, error) {
 	return db.parseResponse(res)
 }
 
+// Write many documents in a single request. Each document succeeds or fails
+// on its own, so the returned slice holds one result per document, in the
+// same order as docs. An error is only returned if the request as a whole
+// failed.
+func (db *Database) BulkDocs(docs []Body) ([]BulkResult, error) {
+	res, err := db.request(http.MethodPost, db.urlFor("_bulk_docs"), Body{"docs": docs})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		if status, err := db.createStatusObject(res); err != nil {
+			return nil, err
+		} else {
+			return nil, status
+		}
+	}
+
+	var results []BulkResult
+	if err := db.decodeJsonBody(res, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// List documents in the database, ordered by id.
+func (db *Database) AllDocs(opts AllDocsOptions) (*AllDocsResult, error) {
+	query := url.Values{}
+	if opts.StartKey != "" {
+		query.Set("startkey", jsonString(opts.StartKey))
+	}
+	if opts.EndKey != "" {
+		query.Set("endkey", jsonString(opts.EndKey))
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Skip > 0 {
+		query.Set("skip", strconv.Itoa(opts.Skip))
+	}
+	if opts.IncludeDocs {
+		query.Set("include_docs", "true")
+	}
+
+	path := db.urlFor("_all_docs")
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var (
+		res *http.Response
+		err error
+	)
+
+	if len(opts.Keys) > 0 {
+		res, err = db.request(http.MethodPost, path, Body{"keys": opts.Keys})
+	} else {
+		res, err = db.request(http.MethodGet, path, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		if status, err := db.createStatusObject(res); err != nil {
+			return nil, err
+		} else {
+			return nil, status
+		}
+	}
+
+	result := &AllDocsResult{}
+	if err := db.decodeJsonBody(res, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
 // Returns true if the database exists.
 func (db *Database) Exists() (bool, error) {
 	res, err := db.request(http.MethodHead, db.urlFor(""), nil)
@@ -266,16 +451,39 @@ func (db *Database) urlFor(id string) string {
 	if id == "" {
 		return db.name
 	}
+
+	// the slash after a special prefix must not be escaped
+	for _, prefix := range []string{"_local/", "_design/"} {
+		if strings.HasPrefix(id, prefix) {
+			return db.name + "/" + prefix + url.QueryEscape(id[len(prefix):])
+		}
+	}
+
 	return db.name + "/" + url.QueryEscape(id)
 }
 
 func (c *Client) request(method, path string, body Body) (*http.Response, error) {
-	req, err := c.createRequest(method, path, nil)
+	req, err := c.createRequest(method, path, body)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.c.Do(req)
+	return c.do(req)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := c.c.Do(req)
+
+	if c.Observer != nil {
+		code := 0
+		if res != nil {
+			code = res.StatusCode
+		}
+		c.Observer(req.Method, code, time.Since(start))
+	}
+
+	return res, err
 }
 
 func (c *Client) createRequest(method, path string, body Body) (*http.Request, error) {
@@ -353,6 +561,28 @@ func (*Client) parseJsonBody(res *http.Response) (Body, error) {
 	}
 }
 
+func (*Client) decodeJsonBody(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Returns true if a request that failed with err may succeed when retried,
+// such as after a network error or a 5xx response. Other error responses
+// will fail the same way every time.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if status, ok := err.(*StatusObject); ok {
+		return status.StatusCode >= 500 ||
+			status.StatusCode == http.StatusRequestTimeout ||
+			status.StatusCode == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
 func (so *StatusObject) Error() string {
 	return fmt.Sprintf("HTTP status %s", so.Status)
 }
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"encoding/json"
 	"encoding/base64"
+	"io/ioutil"
+	"time"
 )
 
 type tearDownFunc func()
@@ -17,9 +19,10 @@ type tearDownFunc func()
 var (
 	TestUrl            string
 	TestRequest        *http.Request
+	TestRequestBody    []byte
 
-	TestResponseStatus = http.StatusOK
-	TestResponseBody   = Body{"ok": true}
+	TestResponseStatus             = http.StatusOK
+	TestResponseBody   interface{} = Body{"ok": true}
 
 	TestUsername = "test-username"
 	TestPassword = "test-password"
@@ -34,6 +37,7 @@ func setupAuthServer() tearDownFunc {
 			var validCreds, givenCreds string
 
 			TestRequest = req
+			TestRequestBody, _ = ioutil.ReadAll(req.Body)
 			emptyCreds := TestUsername == "" && TestPassword == ""
 
 			if !emptyCreds {
@@ -144,6 +148,8 @@ func TestClient_Database(t *testing.T) {
 	for _, td := range testDatabaseUrl {
 		if db, ok := c.Database(td.name).(*Database); !ok {
 			t.Errorf("%T is not *Database", db)
+		} else if db.Name() != td.name {
+			t.Errorf("Name() is %#v, not %#v", db.Name(), td.name)
 		} else if _, err := db.Post(nil); err != nil {
 			t.Errorf("Post error: %s", err.Error())
 		} else {
@@ -156,6 +162,147 @@ func TestClient_Database(t *testing.T) {
 	}
 }
 
+func TestClient_Observer(t *testing.T) {
+	c, err := NewClient(TestUrl, TestAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	var codes []int
+	c.Observer = func(method string, code int, _ time.Duration) {
+		methods = append(methods, method)
+		codes = append(codes, code)
+	}
+
+	db := c.Database(TestDatabase)
+	if _, err := db.Put("a", Body{"_rev": "1-abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, methods, []string{http.MethodPut, http.MethodGet})
+	assert.Equal(t, codes, []int{http.StatusOK, http.StatusOK})
+}
+
+func TestDatabase_urlFor(t *testing.T) {
+	db := &Database{name: "test"}
+	assert.Equal(t, db.urlFor(""), "test")
+	assert.Equal(t, db.urlFor("Pod/default/pod"), "test/Pod%2Fdefault%2Fpod")
+	assert.Equal(t, db.urlFor("_local/kubist/a"), "test/_local/kubist%2Fa")
+	assert.Equal(t, db.urlFor("_design/kubist"), "test/_design/kubist")
+}
+
+func TestDatabase_BulkDocs(t *testing.T) {
+	oldBody := TestResponseBody
+	TestResponseBody = []Body{
+		{"id": "a", "rev": "1-abc", "ok": true},
+		{"id": "b", "error": "conflict", "reason": "Document update conflict."},
+	}
+	defer func() { TestResponseBody = oldBody }()
+
+	c, err := NewClient(TestUrl, TestAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := []Body{{"_id": "a"}, {"_id": "b", "_rev": "1-def"}}
+	results, err := c.Database(TestDatabase).BulkDocs(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, TestRequest.Method, http.MethodPost)
+	assert.Equal(t, TestRequest.URL.Path, "/test-database/_bulk_docs")
+
+	var sent struct{ Docs []Body }
+	if err := json.Unmarshal(TestRequestBody, &sent); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(sent.Docs), 2)
+
+	assert.Equal(t, len(results), 2)
+	assert.Equal(t, results[0].Ok, true)
+	assert.Equal(t, results[0].Rev, "1-abc")
+	assert.Equal(t, results[1].Conflict(), true)
+}
+
+func TestDatabase_AllDocs(t *testing.T) {
+	oldBody := TestResponseBody
+	TestResponseBody = AllDocsResult{
+		TotalRows: 2,
+		Rows: []AllDocsRow{
+			{Id: "Pod/a", Key: "Pod/a", Doc: Body{"_id": "Pod/a"}},
+			{Key: "Pod/b", Error: "not_found"},
+		},
+	}
+	defer func() { TestResponseBody = oldBody }()
+
+	c, err := NewClient(TestUrl, TestAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := c.Database(TestDatabase)
+
+	res, err := db.AllDocs(AllDocsOptions{
+		Keys:        []string{"Pod/a", "Pod/b"},
+		IncludeDocs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, TestRequest.Method, http.MethodPost)
+	assert.Equal(t, TestRequest.URL.Path, "/test-database/_all_docs")
+	assert.Equal(t, TestRequest.URL.Query().Get("include_docs"), "true")
+	assert.Equal(t, string(TestRequestBody), `{"keys":["Pod/a","Pod/b"]}`+"\n")
+	assert.Equal(t, len(res.Rows), 2)
+	assert.Equal(t, res.Rows[0].Doc["_id"], "Pod/a")
+	assert.Equal(t, res.Rows[1].Error, "not_found")
+
+	opts := AllDocsOptions{StartKey: "Pod/", EndKey: "Pod/\ufff0", Limit: 2}
+	if _, err := db.AllDocs(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, TestRequest.Method, http.MethodGet)
+	assert.Equal(t, TestRequest.URL.Query().Get("startkey"), `"Pod/"`)
+	assert.Equal(t, TestRequest.URL.Query().Get("limit"), "2")
+
+	next := opts.NextPage(res)
+	if next == nil {
+		t.Fatal("expected a next page")
+	}
+	assert.Equal(t, next.StartKey, "Pod/b")
+	assert.Equal(t, next.Skip, 1)
+
+	next.Limit = 3
+	if next.NextPage(res) != nil {
+		t.Error("expected no page after a short page")
+	}
+}
+
+func TestClient_AllDbs(t *testing.T) {
+	oldBody := TestResponseBody
+	TestResponseBody = []string{"_users", "kubist/web"}
+	defer func() { TestResponseBody = oldBody }()
+
+	c, err := NewClient(TestUrl, TestAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := c.AllDbs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, TestRequest.URL.Path, "/_all_dbs")
+	assert.Equal(t, names, []string{"_users", "kubist/web"})
+}
+
 func TestDatabase_Changes(t *testing.T) {
 
 }
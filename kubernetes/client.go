@@ -13,3 +13,19 @@ func NewClientConfig(path string, overrides *clientcmd.ConfigOverrides) (*rest.C
 	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
 	return loader.ClientConfig()
 }
+
+// Returns the name of the context NewClientConfig would use.
+func CurrentContext(path string, overrides *clientcmd.ConfigOverrides) (string, error) {
+	if overrides != nil && overrides.CurrentContext != "" {
+		return overrides.CurrentContext, nil
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).RawConfig()
+	if err != nil {
+		return "", err
+	}
+	return raw.CurrentContext, nil
+}
@@ -0,0 +1,114 @@
+package kubernetes
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Resources that aren't reflected unless explicitly included: secrets hold
+// credentials, and events change too often to be worth keeping.
+var DefaultExcludes = []string{"secrets", "events", "events.events.k8s.io"}
+
+// A ResourceFilter matches resources by name, like "pods" for the core group
+// or "deployments.apps", against glob patterns.
+type ResourceFilter struct {
+	// Patterns a resource must match one of. Empty matches everything.
+	Include []string
+	// Patterns a resource must not match.
+	Exclude []string
+}
+
+func (f ResourceFilter) Matches(gvr schema.GroupVersionResource) bool {
+	if len(f.Include) > 0 && !matchResource(f.Include, gvr) {
+		return false
+	}
+	return !matchResource(f.Exclude, gvr)
+}
+
+// Returns the preferred version of every resource the API server can list
+// and watch, including custom resources, that matches the filter.
+func DiscoverResources(
+	d discovery.DiscoveryInterface,
+	filter ResourceFilter,
+) ([]schema.GroupVersionResource, error) {
+	lists, err := d.ServerPreferredResources()
+	if discovery.IsGroupDiscoveryFailedError(err) {
+		// keep the groups that could be discovered
+		fmt.Printf("[!] %s\n", err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return filterResources(lists, filter)
+}
+
+func filterResources(
+	lists []*metav1.APIResourceList,
+	filter ResourceFilter,
+) ([]schema.GroupVersionResource, error) {
+	watchable := discovery.SupportsAllVerbs{Verbs: []string{"list", "watch"}}
+
+	var resources []schema.GroupVersionResource
+	for _, list := range discovery.FilteredBy(watchable, lists) {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range list.APIResources {
+			if strings.Contains(r.Name, "/") {
+				continue // subresources can't be watched on their own
+			}
+
+			if gvr := gv.WithResource(r.Name); filter.Matches(gvr) {
+				resources = append(resources, gvr)
+			}
+		}
+	}
+
+	sort.Slice(resources, func(i, j int) bool {
+		return ResourceName(resources[i]) < ResourceName(resources[j])
+	})
+
+	return resources, nil
+}
+
+// Returns true if gvr is namespaced, according to the API server.
+func IsNamespaced(d discovery.DiscoveryInterface, gvr schema.GroupVersionResource) (bool, error) {
+	list, err := d.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range list.APIResources {
+		if r.Name == gvr.Resource {
+			return r.Namespaced, nil
+		}
+	}
+
+	return false, fmt.Errorf("the server doesn't have a resource %s", ResourceName(gvr))
+}
+
+// Returns the name of gvr as matched by resource patterns, like "pods" for
+// the core group, or "deployments.apps".
+func ResourceName(gvr schema.GroupVersionResource) string {
+	if gvr.Group == "" {
+		return gvr.Resource
+	}
+	return gvr.Resource + "." + gvr.Group
+}
+
+func matchResource(patterns []string, gvr schema.GroupVersionResource) bool {
+	name := ResourceName(gvr)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
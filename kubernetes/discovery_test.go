@@ -0,0 +1,71 @@
+package kubernetes
+
+import (
+	"github.com/magiconair/properties/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+)
+
+var testResourceLists = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "pods", Verbs: []string{"list", "watch", "get"}},
+			{Name: "pods/log", Verbs: []string{"get"}},
+			{Name: "pods/status", Verbs: []string{"list", "watch"}},
+			{Name: "secrets", Verbs: []string{"list", "watch"}},
+			{Name: "bindings", Verbs: []string{"create"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", Verbs: []string{"list", "watch"}},
+		},
+	},
+	{
+		GroupVersion: "example.com/v1alpha1",
+		APIResources: []metav1.APIResource{
+			{Name: "widgets", Verbs: []string{"list", "watch"}},
+		},
+	},
+}
+
+func TestFilterResources(t *testing.T) {
+	var tests = []struct {
+		filter    ResourceFilter
+		resources []schema.GroupVersionResource
+	}{
+		{
+			ResourceFilter{Exclude: DefaultExcludes},
+			[]schema.GroupVersionResource{
+				{Group: "apps", Version: "v1", Resource: "deployments"},
+				{Version: "v1", Resource: "pods"},
+				{Group: "example.com", Version: "v1alpha1", Resource: "widgets"},
+			},
+		},
+		{
+			ResourceFilter{Include: []string{"*.example.com", "secrets"}},
+			[]schema.GroupVersionResource{
+				{Version: "v1", Resource: "secrets"},
+				{Group: "example.com", Version: "v1alpha1", Resource: "widgets"},
+			},
+		},
+		{
+			ResourceFilter{Include: []string{"*"}, Exclude: []string{"*.*"}},
+			[]schema.GroupVersionResource{
+				{Version: "v1", Resource: "pods"},
+				{Version: "v1", Resource: "secrets"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		resources, err := filterResources(testResourceLists, test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resources, test.resources)
+	}
+}
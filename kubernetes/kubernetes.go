@@ -1,100 +1,470 @@
 package kubernetes
 
 import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	r "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	client "k8s.io/client-go/dynamic"
 	"k8s.io/client-go/tools/cache"
+	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
-	// panic on list/watch errors
+	// the reflector retries failed lists and watches on its own
 	r.ErrorHandlers = append(r.ErrorHandlers, func(err error) {
-		panic(err.Error())
+		fmt.Printf("[!] %s\n", err.Error())
 	})
 }
 
+// A ResourceDelta is a change to an object of Resource.
+type ResourceDelta struct {
+	cache.Delta
+	Resource schema.GroupVersionResource
+
+	// The namespace the delta was watched in, or empty for a cluster-wide
+	// watch.
+	Namespace string
+
+	// The resourceVersion a watch can resume from once this delta, and
+	// every delta before it, has been applied. Empty if resuming after
+	// this delta would skip part of a list.
+	Checkpoint string
+
+	// Set on a delete the watcher missed, whose Object only holds what was
+	// known about the object rather than its final state.
+	FinalStateUnknown bool
+
+	// Set on a delete of a document the agent already wrote, to its id,
+	// which is used rather than one derived from Object.
+	DocumentId string
+}
+
+// A ListResult describes a complete list of a resource. The watcher sends
+// every listed object before reporting the list.
+type ListResult struct {
+	Resource        schema.GroupVersionResource
+	Namespace       string
+	Kind            string
+	Keys            map[string]bool
+	UIDs            map[string]bool
+	ResourceVersion string
+}
+
+// Selectors restrict the objects a ResourceWatcher lists and watches, like
+// "app=web" for Label or "spec.type=LoadBalancer" for Field.
+type Selectors struct {
+	Label string
+	Field string
+}
+
 type ResourceWatcher struct {
-	ctr   cache.Controller
+	Resource  schema.GroupVersionResource
+	Namespace string
+
+	// Only objects matching Selectors are sent. Objects that stop matching
+	// are sent as deletes.
+	Selectors Selectors
+
+	// When set, the initial list is skipped and the watch resumes from
+	// this resourceVersion. If the API server has compacted it away, the
+	// watcher falls back to a full list.
+	ResumeFrom string
+
+	// Called after each full list, but not when the list was skipped.
+	OnList func(ListResult)
+
+	// Called each time the watch is restarted, after it closed or failed.
+	OnRestart func()
+
 	r     *cache.Reflector
-	known cache.Store
+	known cache.Store // of knownObject
 	stop  chan struct{}
-	ch    chan cache.Delta
+	ch    chan ResourceDelta
+
+	mu        sync.Mutex
+	resumed   bool // the last list was skipped
+	expired   bool // the last watch failed with 410 Gone
+	lastRv    string
+	listKind  string
+	synced    bool
+	watches   int
+	heartbeat time.Time
+	stopOnce  sync.Once
 }
 
+// Returns a watcher for gvr in namespace, or in every namespace if it's
+// empty. Resources that aren't namespaced are always watched cluster-wide.
 func NewResourceWatcher(
 	c client.Interface,
-	resourceName string,
+	gvr schema.GroupVersionResource,
+	namespaced bool,
 	namespace string,
 ) *ResourceWatcher {
-	ns := true
-	if namespace == "" {
-		ns = false
+	if !namespaced {
+		namespace = ""
 	}
 
 	rc := c.Resource(&metav1.APIResource{
-		Name:       resourceName,
-		Namespaced: ns,
+		Name:       gvr.Resource,
+		Namespaced: namespaced,
 	}, namespace)
 
+	rw := &ResourceWatcher{Resource: gvr, Namespace: namespace}
+
 	lw := &cache.ListWatch{
 		ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
-			return rc.List(o)
-		},
-		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
-			return rc.Watch(o)
-		},
-	}
+			rw.beat()
+			if rv := rw.resumeVersion(); rv != "" {
+				// an empty list makes the reflector watch from rv
+				list := &unstructured.UnstructuredList{Object: map[string]interface{}{}}
+				list.SetResourceVersion(rv)
+				return list, nil
+			}
 
-	rw := &ResourceWatcher{}
+			rw.selectors(&o)
+			list, err := rc.List(o)
+			if l, ok := list.(*unstructured.UnstructuredList); ok {
+				rw.mu.Lock()
+				rw.listKind = strings.TrimSuffix(l.GetKind(), "List")
+				rw.mu.Unlock()
+			}
 
-	rw.ch = make(chan cache.Delta)
-	rw.stop = make(chan struct{})
+			return list, err
+		},
+		WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+			rw.beat()
 
-	rw.known = cache.NewStore(stringIdentityKeyFunc)
-	fifo := cache.NewDeltaFIFO(cache.DeletionHandlingMetaNamespaceKeyFunc, nil, rw.known)
-
-	rw.ctr = cache.New(&cache.Config{
-		Queue:         fifo,
-		ListerWatcher: lw,
-		//FullResyncPeriod: time.Second * 10,
-		Process: func(o interface{}) error {
-			for _, d := range o.(cache.Deltas) {
-				id, err := cache.MetaNamespaceKeyFunc(d.Object)
-				if err != nil {
-					return err
-				}
+			rw.mu.Lock()
+			rw.watches++
+			restarted := rw.watches > 1
+			rw.mu.Unlock()
 
-				// Ensure deletes only happen once by tracking known keys.
-				switch d.Type {
-				case cache.Added, cache.Sync, cache.Updated:
-					rw.known.Add(id)
-				case cache.Deleted:
-					rw.known.Delete(id)
-				}
+			if restarted && rw.OnRestart != nil {
+				rw.OnRestart()
+			}
 
-				rw.ch <- d
+			rw.selectors(&o)
+			w, err := rc.Watch(o)
+			if err != nil {
+				rw.checkExpired(err)
+				return nil, err
 			}
 
-			return nil
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				rw.beat()
+				if e.Type == watch.Error {
+					rw.checkExpired(apierrors.FromObject(e.Object))
+				}
+				return e, true
+			}), nil
 		},
-	})
+	}
+
+	rw.ch = make(chan ResourceDelta)
+	rw.stop = make(chan struct{})
+	rw.known = cache.NewStore(knownObjectKeyFunc)
+	rw.r = cache.NewReflector(lw, &unstructured.Unstructured{}, &deltaStore{rw}, 0)
 
 	return rw
 }
 
-func stringIdentityKeyFunc(o interface{}) (string, error) {
-	return o.(string), nil
+// The key and UID of an object the watcher has sent, so a delete it misses
+// can still name the object.
+type knownObject struct {
+	Key string
+	UID types.UID
 }
 
-func (rw *ResourceWatcher) Watch() <-chan cache.Delta {
-	go rw.ctr.Run(rw.stop)
+func knownObjectKeyFunc(o interface{}) (string, error) {
+	return o.(knownObject).Key, nil
+}
+
+// Returns the object deleted by a DeletedFinalStateUnknown tombstone. When
+// the tombstone doesn't hold it, the object only has the apiVersion of
+// resource, kind, and the namespace and name from the tombstone's key.
+func TombstoneObject(t cache.DeletedFinalStateUnknown, resource schema.GroupVersionResource, kind string) (*unstructured.Unstructured, error) {
+	if obj, ok := t.Obj.(*unstructured.Unstructured); ok {
+		return obj, nil
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(t.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAPIVersion(resource.GroupVersion().String())
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj, nil
+}
+
+func (rw *ResourceWatcher) Watch() <-chan ResourceDelta {
+	rw.mu.Lock()
+	rw.lastRv = rw.ResumeFrom
+	rw.heartbeat = time.Now()
+	rw.mu.Unlock()
+
+	go func() {
+		rw.r.Run(rw.stop)
+		close(rw.ch)
+	}()
+
 	return rw.ch
 }
 
+// Stop watching. The watch channel is closed once the reflector returns.
 func (rw *ResourceWatcher) Stop() {
-	var s struct{}
-	rw.stop <- s
+	rw.stopOnce.Do(func() {
+		close(rw.stop)
+	})
+}
+
+// Returns the kind of the objects in the last full list, or "" before the
+// first one.
+func (rw *ResourceWatcher) Kind() string {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.listKind
+}
+
+// Returns true once the initial list has been sent, or skipped.
+func (rw *ResourceWatcher) HasSynced() bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.synced
+}
+
+// Returns the last time the watch loop made progress: when it listed,
+// started watching, or received an event. The reflector restarts each watch
+// within ten minutes, so a quiet resource still makes progress.
+func (rw *ResourceWatcher) LastHeartbeat() time.Time {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.heartbeat
+}
+
+func (rw *ResourceWatcher) selectors(o *metav1.ListOptions) {
+	o.LabelSelector = rw.Selectors.Label
+	o.FieldSelector = rw.Selectors.Field
+}
+
+func (rw *ResourceWatcher) beat() {
+	rw.mu.Lock()
+	rw.heartbeat = time.Now()
+	rw.mu.Unlock()
+}
+
+// Returns the resourceVersion to resume watching from, or "" if the
+// reflector should list everything.
+func (rw *ResourceWatcher) resumeVersion() string {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.expired {
+		fmt.Printf("[!] %s: resourceVersion %s expired, listing all\n",
+			rw.Resource.Resource, rw.lastRv)
+		rw.expired = false
+		rw.lastRv = ""
+	}
+
+	rw.resumed = rw.lastRv != ""
+	return rw.lastRv
+}
+
+func (rw *ResourceWatcher) checkExpired(err error) {
+	if apierrors.IsGone(err) || apierrors.IsResourceExpired(err) {
+		rw.mu.Lock()
+		rw.expired = true
+		rw.mu.Unlock()
+	}
+}
+
+// Send a delta to the watch channel, unless the watcher is stopped first.
+func (rw *ResourceWatcher) send(t cache.DeltaType, obj interface{}, checkpoint string) error {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return err
+	}
+
+	// Ensure deletes only happen once by tracking known keys.
+	switch t {
+	case cache.Added, cache.Sync, cache.Updated:
+		known := knownObject{Key: key}
+		if m, err := meta.Accessor(obj); err == nil {
+			known.UID = m.GetUID()
+		}
+		rw.known.Add(known)
+	case cache.Deleted:
+		rw.known.Delete(knownObject{Key: key})
+	}
+
+	d := ResourceDelta{
+		Delta:      cache.Delta{Type: t, Object: obj},
+		Resource:   rw.Resource,
+		Namespace:  rw.Namespace,
+		Checkpoint: checkpoint,
+	}
+
+	select {
+	case rw.ch <- d:
+	case <-rw.stop:
+	}
+
+	return nil
+}
+
+// Send a watch event, which can be resumed from once applied.
+func (rw *ResourceWatcher) sendEvent(t cache.DeltaType, obj interface{}) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+
+	rv := accessor.GetResourceVersion()
+	if err := rw.send(t, obj, rv); err != nil {
+		return err
+	}
+
+	rw.mu.Lock()
+	rw.lastRv = rv
+	rw.mu.Unlock()
+	return nil
+}
+
+// deltaStore is the store behind a ResourceWatcher's reflector. Instead of
+// keeping objects, it sends every change to the watcher's channel in the
+// order the reflector saw them, so resourceVersions only move forward.
+type deltaStore struct {
+	rw *ResourceWatcher
+}
+
+var _ cache.Store = &deltaStore{}
+
+func (s *deltaStore) Add(obj interface{}) error {
+	return s.rw.sendEvent(cache.Added, obj)
+}
+
+func (s *deltaStore) Update(obj interface{}) error {
+	return s.rw.sendEvent(cache.Updated, obj)
+}
+
+func (s *deltaStore) Delete(obj interface{}) error {
+	return s.rw.sendEvent(cache.Deleted, obj)
+}
+
+// Sends every listed object, followed by deletes for known objects that
+// weren't listed. Their final state is unknown, so each is sent as a
+// DeletedFinalStateUnknown tombstone holding an object with its kind, name
+// and UID, and the list's resourceVersion, since it was gone by then. Only
+// the last delta can be resumed from, since resuming part way through would
+// skip the rest of the list.
+func (s *deltaStore) Replace(list []interface{}, rv string) error {
+	rw := s.rw
+
+	rw.mu.Lock()
+	resumed := rw.resumed
+	rw.resumed = false
+	rw.mu.Unlock()
+
+	if !resumed {
+		kind := rw.Kind()
+		var deltas []cache.Delta
+
+		listed := make(map[string]bool, len(list))
+		uids := make(map[string]bool, len(list))
+		for _, obj := range list {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				return err
+			}
+
+			listed[key] = true
+			if m, err := meta.Accessor(obj); err == nil {
+				uids[string(m.GetUID())] = true
+			}
+			deltas = append(deltas, cache.Delta{Type: cache.Sync, Object: obj})
+		}
+
+		for _, item := range rw.known.List() {
+			known := item.(knownObject)
+			if listed[known.Key] {
+				continue
+			}
+
+			obj, err := TombstoneObject(cache.DeletedFinalStateUnknown{Key: known.Key}, rw.Resource, kind)
+			if err != nil {
+				return err
+			}
+			obj.SetUID(known.UID)
+			obj.SetResourceVersion(rv)
+
+			deltas = append(deltas, cache.Delta{
+				Type:   cache.Deleted,
+				Object: cache.DeletedFinalStateUnknown{Key: known.Key, Obj: obj},
+			})
+		}
+
+		for i, d := range deltas {
+			var checkpoint string
+			if i == len(deltas)-1 {
+				checkpoint = rv
+			}
+
+			if err := rw.send(d.Type, d.Object, checkpoint); err != nil {
+				return err
+			}
+		}
+
+		if rw.OnList != nil {
+			rw.OnList(ListResult{
+				Resource:        rw.Resource,
+				Namespace:       rw.Namespace,
+				Kind:            kind,
+				Keys:            listed,
+				UIDs:            uids,
+				ResourceVersion: rv,
+			})
+		}
+	}
+
+	rw.mu.Lock()
+	rw.lastRv = rv
+	rw.synced = true
+	rw.mu.Unlock()
+	return nil
+}
+
+func (s *deltaStore) Resync() error {
+	return nil
+}
+
+func (s *deltaStore) List() []interface{} {
+	return s.rw.known.List()
+}
+
+func (s *deltaStore) ListKeys() []string {
+	return s.rw.known.ListKeys()
+}
+
+func (s *deltaStore) Get(obj interface{}) (interface{}, bool, error) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return s.rw.known.GetByKey(key)
+}
+
+func (s *deltaStore) GetByKey(key string) (interface{}, bool, error) {
+	return s.rw.known.GetByKey(key)
 }
@@ -0,0 +1,88 @@
+package kubernetes
+
+import (
+	"github.com/magiconair/properties/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestDeltaStore_Replace(t *testing.T) {
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	rw := &ResourceWatcher{
+		Resource: pods,
+		ch:       make(chan ResourceDelta, 10),
+		stop:     make(chan struct{}),
+		known:    cache.NewStore(knownObjectKeyFunc),
+		listKind: "Pod",
+	}
+
+	var lists []ListResult
+	rw.OnList = func(list ListResult) {
+		lists = append(lists, list)
+	}
+
+	pod := func(name string) interface{} {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("Pod")
+		obj.SetNamespace("default")
+		obj.SetName(name)
+		obj.SetUID(types.UID("uid-" + name))
+		return obj
+	}
+
+	store := &deltaStore{rw}
+	if err := store.Replace([]interface{}{pod("web"), pod("db")}, "5"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		<-rw.ch
+	}
+
+	if err := store.Replace([]interface{}{pod("web")}, "9"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, (<-rw.ch).Type, cache.Sync)
+
+	// the missing object is deleted with a tombstone naming it
+	delta := <-rw.ch
+	assert.Equal(t, delta.Type, cache.Deleted)
+	assert.Equal(t, delta.Checkpoint, "9")
+
+	tombstone, ok := delta.Object.(cache.DeletedFinalStateUnknown)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, tombstone.Key, "default/db")
+
+	obj, err := TombstoneObject(tombstone, pods, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, obj.GetKind(), "Pod")
+	assert.Equal(t, obj.GetName(), "db")
+	assert.Equal(t, obj.GetUID(), types.UID("uid-db"))
+	assert.Equal(t, obj.GetResourceVersion(), "9")
+
+	assert.Equal(t, len(lists), 2)
+	assert.Equal(t, lists[1].Keys, map[string]bool{"default/web": true})
+	assert.Equal(t, lists[1].UIDs, map[string]bool{"uid-web": true})
+}
+
+func TestTombstoneObject(t *testing.T) {
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	obj, err := TombstoneObject(cache.DeletedFinalStateUnknown{Key: "default/web"}, deployments, "Deployment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, obj.GetAPIVersion(), "apps/v1")
+	assert.Equal(t, obj.GetKind(), "Deployment")
+	assert.Equal(t, obj.GetNamespace(), "default")
+	assert.Equal(t, obj.GetName(), "web")
+
+	_, err = TombstoneObject(cache.DeletedFinalStateUnknown{Key: "a/b/c"}, deployments, "Deployment")
+	assert.Equal(t, err != nil, true)
+}